@@ -12,6 +12,7 @@ import (
 	"github.com/busbud/tidalwave/logger"
 	"github.com/busbud/tidalwave/parser"
 	"github.com/busbud/tidalwave/server"
+	"github.com/busbud/tidalwave/sqlquery"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -67,6 +68,16 @@ func cliQuery() {
 		fmt.Println(string(str))
 	case parser.IntResults:
 		fmt.Println(res.Results)
+	case parser.FloatResults:
+		if res.Results == nil {
+			fmt.Println("null")
+		} else {
+			fmt.Println(*res.Results)
+		}
+	case parser.TableResults:
+		for _, row := range *res.Results {
+			fmt.Println(string(row))
+		}
 	}
 }
 
@@ -120,6 +131,12 @@ Home: https://github.com/busbud/tidalwave`,
 		"Set the maximum amount of threads to run when processing log files during queries. Default is the number of cores on system.")
 	flags.StringP("logroot", "r", "./logs", "Log root directory where log files are stored")
 	flags.Bool("debug", false, "Enable debug logging")
+	flags.String("timestamp-key", sqlquery.DefaultTimestampKey, "JSON path to the timestamp of each log line, used to filter lines by date and by date_trunc and time_bucket")
+	flags.StringSlice("timestamp-format", []string{}, "Go time layouts of each log line's timestamp, tried before ISO 8601 and unix epochs")
+	flags.String("timezone", sqlquery.DefaultTimezone, "Time zone of dates in queries without an offset, such as America/Montreal")
+	flags.Int("max-join-memory", parser.DefaultMaxJoinMemory, "Maximum megabytes of lines a JOIN can hold in memory for every app but the one with the largest log files")
+	flags.Int("max-subquery-memory", parser.DefaultMaxSubqueryMemory, "Maximum megabytes of values each IN (SELECT ...) subquery can hold in memory")
+	flags.Int("max-union-memory", parser.DefaultMaxUnionMemory, "Maximum megabytes of rows a UNION can hold in memory to skip duplicate rows")
 
 	// Cli Flags
 	flags.StringP("query", "q", "", "SQL query to execute against logs. '-' is accepted for piping in from stdin.")
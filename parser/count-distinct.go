@@ -2,11 +2,12 @@
 package parser
 
 import (
+	"encoding/json"
+	"strings"
 	"sync"
 
 	"github.com/busbud/tidalwave/logger"
 	"github.com/busbud/tidalwave/sqlquery"
-	"github.com/tidwall/gjson"
 )
 
 func distinctCountParse(query *sqlquery.QueryParams, resultsChan chan<- map[string]int, logPath string, wg *sync.WaitGroup) {
@@ -15,10 +16,11 @@ func distinctCountParse(query *sqlquery.QueryParams, resultsChan chan<- map[stri
 	results := map[string]int{}
 	err := readLines(logPath, func(line *[]byte) {
 		if query.ProcessLine(line) {
-			res := gjson.GetBytes(*line, query.AggrPath)
-			if res.Type != 0 {
-				value := res.String()
-				results[value]++
+			for _, res := range sqlquery.KeyValues(*line, query.AggrPath) {
+				if res.Type != 0 {
+					value := res.String()
+					results[value]++
+				}
 			}
 		}
 	})
@@ -33,7 +35,57 @@ func distinctCountParse(query *sqlquery.QueryParams, resultsChan chan<- map[stri
 // CountDistinct executes a COUNT(DISTINCT()) query over log results.
 // SELECT COUNT(DISTINCT(line.cmd)) FROM testapp WHERE date > '2016-10-05'
 func (tp *TidalwaveParser) CountDistinct() *map[string]int { //nolint:gocritic // Leave it alone.
+	mergedResults := tp.countDistinct()
+	if tp.Query.Limit < 0 && tp.Query.Offset == 0 && tp.Query.Having == nil && len(tp.Query.OrderBy) == 0 {
+		return &mergedResults
+	}
+
+	limitedResults := map[string]int{}
+	for _, key := range tp.countDistinctKeys(mergedResults) {
+		limitedResults[key] = mergedResults[key]
+	}
+
+	return &limitedResults
+}
+
+// CountDistinctRows executes a COUNT(DISTINCT()) query with an ORDER BY, returning a row per value in order as objects
+// have no order.
+// SELECT COUNT(DISTINCT(line.cmd)) FROM testapp ORDER BY COUNT(*) DESC
+func (tp *TidalwaveParser) CountDistinctRows() *[]json.RawMessage {
+	mergedResults := tp.countDistinct()
+	keyName := countDistinctKeyName(tp.Query)
+
+	rows := []json.RawMessage{}
+	for _, key := range tp.countDistinctKeys(mergedResults) {
+		rows = append(rows, jsonRow(keyName, key, "count", mergedResults[key]))
+	}
+
+	return &rows
+}
+
+// countDistinctKeyName returns the name values are given in rows, such as cmd for line.cmd.
+func countDistinctKeyName(query *sqlquery.QueryParams) string {
+	return query.AggrPath[strings.LastIndex(query.AggrPath, ".")+1:]
+}
+
+// countDistinctKeys applies HAVING, ORDER BY, LIMIT and OFFSET to the sorted values. Each value is matched as the row
+// {"cmd":"value","count":10}, the same as when it's selected within a WITH or UNION.
+func (tp *TidalwaveParser) countDistinctKeys(mergedResults map[string]int) []string {
+	keyName := countDistinctKeyName(tp.Query)
+	keys := tp.filterOutputRows(sortedKeys(mergedResults), func(key string) []byte {
+		return jsonRow(keyName, key, "count", mergedResults[key])
+	})
+
+	return limitKeys(tp.Query, keys)
+}
+
+func (tp *TidalwaveParser) countDistinct() map[string]int {
 	logsLen := len(tp.LogPaths)
+	if logsLen == 0 {
+		// No results would ever be received to release the wait group.
+		return map[string]int{}
+	}
+
 	resultsChan := make(chan map[string]int, logsLen)
 
 	var wg sync.WaitGroup
@@ -66,5 +118,5 @@ func (tp *TidalwaveParser) CountDistinct() *map[string]int { //nolint:gocritic /
 	}
 
 	results = nil // Manual GC
-	return &mergedResults
+	return mergedResults
 }
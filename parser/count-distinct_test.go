@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/busbud/tidalwave/sqlquery"
+)
+
+// writeLines writes lines to a log file in dir, returning its path.
+func writeLines(t *testing.T, dir, name string, lines ...string) string {
+	logPath := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return logPath
+}
+
+func TestCountDistinctOrderBy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPaths := []string{
+		writeLines(t, dir, "00.log", `{"cmd":"a"}`, `{"cmd":"b"}`, `{"cmd":"c"}`),
+		writeLines(t, dir, "01.log", `{"cmd":"b"}`, `{"cmd":"c"}`, `{"cmd":"b"}`, `{"cmd":"d"}`, `{"cmd":"d"}`),
+	}
+
+	tests := []struct {
+		orderBy []sqlquery.OrderParam
+		limit   int
+		want    string
+	}{
+		{[]sqlquery.OrderParam{{KeyPath: "count", Desc: true}}, -1, `[{"cmd":"b","count":3},{"cmd":"c","count":2},{"cmd":"d","count":2},{"cmd":"a","count":1}]`},
+		{[]sqlquery.OrderParam{{KeyPath: "count", Desc: true}, {KeyPath: "cmd", Desc: true}}, 2, `[{"cmd":"b","count":3},{"cmd":"d","count":2}]`},
+		{[]sqlquery.OrderParam{{KeyPath: "cmd", Desc: true}}, -1, `[{"cmd":"d","count":2},{"cmd":"c","count":2},{"cmd":"b","count":3},{"cmd":"a","count":1}]`},
+	}
+
+	for _, test := range tests {
+		tp := TidalwaveParser{MaxParallelism: 2, LogPaths: logPaths, Query: &sqlquery.QueryParams{
+			Type:     sqlquery.TypeCountDistinct,
+			AggrPath: "cmd",
+			Limit:    test.limit,
+			OrderBy:  test.orderBy,
+		}}
+
+		got, _ := json.Marshal(tp.CountDistinctRows())
+		if string(got) != test.want {
+			t.Errorf("ORDER BY %+v LIMIT %d returned %s, want %s", test.orderBy, test.limit, got, test.want)
+		}
+
+		// Without rows, ORDER BY still applies LIMIT to the ordered values.
+		if counts := *tp.CountDistinct(); test.limit == 2 && (len(counts) != 2 || counts["b"] != 3 || counts["d"] != 2) {
+			t.Errorf("ORDER BY %+v LIMIT %d returned %v", test.orderBy, test.limit, counts)
+		}
+	}
+}
@@ -29,6 +29,11 @@ func countParse(query *sqlquery.QueryParams, resultsChan chan<- int, logPath str
 // SELECT COUNT(*) FROM testapp WHERE date > '2016-10-05'
 func (tp *TidalwaveParser) Count() int {
 	logsLen := len(tp.LogPaths)
+	if logsLen == 0 {
+		// No results would ever be received to release the wait group.
+		return 0
+	}
+
 	resultsChan := make(chan int, logsLen)
 
 	var wg sync.WaitGroup
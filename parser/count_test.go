@@ -0,0 +1,54 @@
+package parser
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/busbud/tidalwave/sqlquery"
+)
+
+func TestCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// {"file":f,"line":l} for 3 files of 4 lines.
+	logPaths := writeTestLogs(t, dir, 3, 4)
+
+	tests := []struct {
+		name     string
+		logPaths []string
+		query    func(tp *TidalwaveParser) interface{}
+		want     string
+	}{
+		{"count", logPaths, func(tp *TidalwaveParser) interface{} { return tp.Count() }, `12`},
+		{"count without log files", []string{}, func(tp *TidalwaveParser) interface{} { return tp.Count() }, `0`},
+		{"count distinct", logPaths, func(tp *TidalwaveParser) interface{} { return tp.CountDistinct() }, `{"0":4,"1":4,"2":4}`},
+		{"count distinct without log files", []string{}, func(tp *TidalwaveParser) interface{} { return tp.CountDistinct() }, `{}`},
+		{"distinct without log files", []string{}, func(tp *TidalwaveParser) interface{} { return tp.Distinct() }, `[]`},
+	}
+
+	for _, test := range tests {
+		tp := &TidalwaveParser{MaxParallelism: 2, LogPaths: test.logPaths, Query: &sqlquery.QueryParams{AggrPath: "file", Limit: -1}}
+
+		done := make(chan string)
+		go func() {
+			b, _ := json.Marshal(test.query(tp))
+			done <- string(b)
+		}()
+
+		select {
+		case got := <-done:
+			if got != test.want {
+				t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: never returned", test.name)
+		}
+	}
+}
@@ -7,10 +7,11 @@ import "sort"
 // SELECT DISTINCT(line.cmd) FROM testapp WHERE date > '2016-10-05'
 func (tp *TidalwaveParser) Distinct() *[]string {
 	keys := []string{}
-	for key := range *tp.CountDistinct() {
+	for key := range tp.countDistinct() {
 		keys = append(keys, key)
 	}
 
 	sort.Strings(keys)
+	keys = limitKeys(tp.Query, keys)
 	return &keys
 }
@@ -0,0 +1,459 @@
+// Package parser handles parsing log files based on the SQL execution type.
+package parser
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/busbud/tidalwave/logger"
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/tidwall/gjson"
+)
+
+// aggregateState holds the partial result of an aggregate function. States are created per log file and merged once
+// all files have been parsed.
+type aggregateState interface {
+	add(value gjson.Result)
+	merge(other aggregateState)
+	result() string
+}
+
+type countState struct {
+	count int
+}
+
+func (s *countState) add(value gjson.Result) {
+	s.count++
+}
+
+func (s *countState) merge(other aggregateState) {
+	s.count += other.(*countState).count
+}
+
+func (s *countState) result() string {
+	return strconv.Itoa(s.count)
+}
+
+type countDistinctState struct {
+	values map[string]bool
+}
+
+func (s *countDistinctState) add(value gjson.Result) {
+	s.values[value.Raw] = true
+}
+
+func (s *countDistinctState) merge(other aggregateState) {
+	for key := range other.(*countDistinctState).values {
+		s.values[key] = true
+	}
+}
+
+func (s *countDistinctState) result() string {
+	return strconv.Itoa(len(s.values))
+}
+
+// toFloat returns a JSON value as a number, including numbers that were logged as strings.
+func toFloat(value gjson.Result) (float64, bool) {
+	switch value.Type {
+	case gjson.Number:
+		return value.Num, true
+	case gjson.String:
+		f, err := strconv.ParseFloat(value.Str, 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// sumState handles both SUM() and AVG().
+type sumState struct {
+	average bool
+	count   int
+	sum     float64
+}
+
+func (s *sumState) add(value gjson.Result) {
+	if f, ok := toFloat(value); ok {
+		s.count++
+		s.sum += f
+	}
+}
+
+func (s *sumState) merge(other aggregateState) {
+	otherState := other.(*sumState)
+	s.count += otherState.count
+	s.sum += otherState.sum
+}
+
+func (s *sumState) result() string {
+	if s.count == 0 {
+		return "null"
+	}
+
+	if s.average {
+		return formatFloat(s.sum / float64(s.count))
+	}
+
+	return formatFloat(s.sum)
+}
+
+// minMaxState handles both MIN() and MAX().
+type minMaxState struct {
+	max   bool
+	set   bool
+	value float64
+}
+
+func (s *minMaxState) add(value gjson.Result) {
+	if f, ok := toFloat(value); ok {
+		if !s.set || (s.max && f > s.value) || (!s.max && f < s.value) {
+			s.value = f
+			s.set = true
+		}
+	}
+}
+
+func (s *minMaxState) merge(other aggregateState) {
+	otherState := other.(*minMaxState)
+	if otherState.set {
+		s.add(gjson.Result{Type: gjson.Number, Num: otherState.value})
+	}
+}
+
+func (s *minMaxState) result() string {
+	if !s.set {
+		return "null"
+	}
+
+	return formatFloat(s.value)
+}
+
+func newAggregateState(column *sqlquery.Column) aggregateState {
+	switch column.Function {
+	case "sum":
+		return &sumState{}
+	case "avg":
+		return &sumState{average: true}
+	case "min":
+		return &minMaxState{}
+	case "max":
+		return &minMaxState{max: true}
+	case sqlquery.FunctionPercentile:
+		return &percentileState{percentile: column.FuncArg, sketch: newQuantileSketch()}
+	case sqlquery.FunctionHistogram:
+		return &histogramState{buckets: map[int]int{}, width: column.FuncArg}
+	case sqlquery.FunctionApproxCountDistinct:
+		return &approxCountDistinctState{sketch: &hyperLogLog{}}
+	}
+
+	if column.Distinct {
+		return &countDistinctState{values: map[string]bool{}}
+	}
+
+	return &countState{}
+}
+
+// groupRow holds the GROUP BY key values and aggregate states for a single group.
+type groupRow struct {
+	keys   []string
+	states []aggregateState
+}
+
+func newGroupRow(query *sqlquery.QueryParams, keys []string) *groupRow {
+	row := &groupRow{keys: keys, states: make([]aggregateState, len(query.Columns))}
+	for idx := range query.Columns {
+		if query.Columns[idx].IsAggregate() {
+			row.states[idx] = newAggregateState(&query.Columns[idx])
+		}
+	}
+
+	return row
+}
+
+func (row *groupRow) merge(other *groupRow) {
+	for idx, state := range row.states {
+		if state != nil {
+			state.merge(other.states[idx])
+		}
+	}
+}
+
+// toJSON formats the row in to a JSON object using the selected column names as keys. Rows evaluated by HAVING and
+// ORDER BY include hidden columns, and are keyed by column index instead.
+func (row *groupRow) toJSON(query *sqlquery.QueryParams, indexed bool) json.RawMessage {
+	entries := []string{}
+	for idx := range query.Columns {
+		column := &query.Columns[idx]
+		name := column.Name
+		switch {
+		case indexed:
+			name = strconv.Itoa(idx)
+		case column.Hidden:
+			continue
+		}
+
+		var value string
+		if column.IsAggregate() {
+			value = row.states[idx].result()
+		} else {
+			value = row.keys[column.GroupIdx]
+		}
+
+		entries = append(entries, `"`+name+`":`+value)
+	}
+
+	return json.RawMessage("{" + strings.Join(entries, ",") + "}")
+}
+
+// groupPaths returns every key path that needs to be read from a line, GROUP BY keys first followed by aggregate
+// function arguments.
+func groupPaths(query *sqlquery.QueryParams) []string {
+	paths := []string{}
+	for idx := range query.GroupBy {
+		paths = append(paths, query.GroupBy[idx].KeyPath)
+	}
+
+	for idx := range query.Columns {
+		if query.Columns[idx].IsAggregate() && query.Columns[idx].KeyPath != "" {
+			paths = append(paths, query.Columns[idx].KeyPath)
+		}
+	}
+
+	return paths
+}
+
+// groupKeyValue returns the raw JSON value a line is grouped by for key, truncating timestamps for time buckets.
+func groupKeyValue(query *sqlquery.QueryParams, key *sqlquery.GroupKey, value gjson.Result) string {
+	if key.IsTime() {
+		if t, ok := sqlquery.ParseTimestamp(value, query.TimestampLayouts...); ok {
+			return `"` + key.Truncate(t).Format(time.RFC3339) + `"`
+		}
+		return "null"
+	}
+
+	if value.Raw == "" {
+		return "null"
+	}
+
+	return value.Raw
+}
+
+func groupByParse(query *sqlquery.QueryParams, resultsChan chan<- map[string]*groupRow, logPath string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	paths := groupPaths(query)
+	groupLen := len(query.GroupBy)
+	results := map[string]*groupRow{}
+	err := readLines(logPath, func(line *[]byte) {
+		if !query.ProcessLine(line) {
+			return
+		}
+
+		values := gjson.GetManyBytes(*line, paths...)
+		keys := make([]string, groupLen)
+		for idx := range keys {
+			keys[idx] = groupKeyValue(query, &query.GroupBy[idx], values[idx])
+		}
+
+		groupKey := strings.Join(keys, "\x00")
+		row, ok := results[groupKey]
+		if !ok {
+			row = newGroupRow(query, keys)
+			results[groupKey] = row
+		}
+
+		valueIdx := groupLen
+		for idx := range query.Columns {
+			column := &query.Columns[idx]
+			if !column.IsAggregate() {
+				continue
+			}
+
+			value := gjson.Result{}
+			if column.KeyPath != "" {
+				value = values[valueIdx]
+				valueIdx++
+			}
+
+			if !column.MatchesFilter(line) {
+				continue
+			}
+
+			// Aggregate functions skip missing and null values, except for COUNT(*).
+			switch {
+			case column.CountsLines():
+				row.states[idx].add(gjson.Result{})
+				continue
+			case column.Expression != nil:
+				value = column.Expression.Eval(*line)
+			}
+
+			if value.Type != gjson.Null {
+				row.states[idx].add(value)
+			}
+		}
+	})
+
+	if err != nil {
+		logger.Log.Fatal(err)
+	}
+
+	resultsChan <- results
+}
+
+// groupByFiles parses every log file in parallel, returning the groups found in each of them.
+func (tp *TidalwaveParser) groupByFiles() []map[string]*groupRow {
+	logsLen := len(tp.LogPaths)
+	if logsLen == 0 {
+		// No results would ever be received to release the wait group.
+		return nil
+	}
+
+	resultsChan := make(chan map[string]*groupRow, logsLen)
+
+	var wg sync.WaitGroup
+	wg.Add(logsLen + 1)
+
+	results := []map[string]*groupRow{}
+	coreLimit := make(chan bool, tp.MaxParallelism)
+	go func() {
+		for res := range resultsChan {
+			results = append(results, res)
+			<-coreLimit
+			if len(results) == logsLen {
+				wg.Done()
+			}
+		}
+	}()
+
+	for i := 0; i < logsLen; i++ {
+		go groupByParse(tp.Query, resultsChan, tp.LogPaths[i], &wg)
+		coreLimit <- true
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+func (tp *TidalwaveParser) groupBy() map[string]*groupRow {
+	results := tp.groupByFiles()
+
+	mergedResults := map[string]*groupRow{}
+	for idx := range results {
+		for key, row := range results[idx] {
+			if mergedRow, ok := mergedResults[key]; ok {
+				mergedRow.merge(row)
+			} else {
+				mergedResults[key] = row
+			}
+		}
+	}
+	results = nil // Manual GC
+
+	// Aggregates without GROUP BY always return a row, even when no lines matched.
+	if len(tp.Query.GroupBy) == 0 && len(mergedResults) == 0 {
+		mergedResults[""] = newGroupRow(tp.Query, []string{})
+	}
+
+	return mergedResults
+}
+
+// GroupBy executes a GROUP BY query over log results, returning a JSON object per group.
+// SELECT line.host, line.cmd, COUNT(*) FROM testapp WHERE date > '2016-10-05' GROUP BY line.host, line.cmd
+func (tp *TidalwaveParser) GroupBy() *[]json.RawMessage {
+	mergedResults := tp.groupBy()
+
+	keys := []string{}
+	for key := range mergedResults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Time series are ordered by their time bucket first. Buckets are compared as times since their offsets change with
+	// daylight saving time, and lines without a timestamp come last.
+	for idx := range tp.Query.GroupBy {
+		if tp.Query.GroupBy[idx].IsTime() {
+			sort.SliceStable(keys, func(i, j int) bool {
+				a, aErr := time.Parse(time.RFC3339, strings.Trim(mergedResults[keys[i]].keys[idx], `"`))
+				b, bErr := time.Parse(time.RFC3339, strings.Trim(mergedResults[keys[j]].keys[idx], `"`))
+				if aErr != nil || bErr != nil {
+					return aErr == nil && bErr != nil
+				}
+				return a.Before(b)
+			})
+			break
+		}
+	}
+
+	keys = tp.filterOutputRows(keys, func(key string) []byte {
+		return mergedResults[key].toJSON(tp.Query, true)
+	})
+
+	rows := []json.RawMessage{}
+	for _, key := range limitKeys(tp.Query, keys) {
+		rows = append(rows, mergedResults[key].toJSON(tp.Query, false))
+	}
+
+	return &rows
+}
+
+// filterOutputRows removes the keys of output rows not matching the HAVING clause, then orders the remaining keys by
+// the ORDER BY clause. Keys keep their current order when there's no ORDER BY, or when rows are equal.
+func (tp *TidalwaveParser) filterOutputRows(keys []string, outputRow func(key string) []byte) []string {
+	if tp.Query.Having == nil && len(tp.Query.OrderBy) == 0 {
+		return keys
+	}
+
+	filteredKeys := []string{}
+	rows := map[string]*sortRow{}
+	for _, key := range keys {
+		row := outputRow(key)
+		if !tp.Query.ProcessHaving(&row) {
+			continue
+		}
+
+		filteredKeys = append(filteredKeys, key)
+		if len(tp.Query.OrderBy) > 0 {
+			rows[key] = &sortRow{keys: make([]gjson.Result, len(tp.Query.OrderBy))}
+			for idx := range tp.Query.OrderBy {
+				rows[key].keys[idx] = gjson.GetBytes(row, tp.Query.OrderBy[idx].KeyPath)
+			}
+		}
+	}
+
+	if len(tp.Query.OrderBy) > 0 {
+		sort.SliceStable(filteredKeys, func(i, j int) bool {
+			return lessRow(tp.Query.OrderBy, rows[filteredKeys[i]], rows[filteredKeys[j]])
+		})
+	}
+
+	return filteredKeys
+}
+
+// Aggregate executes a single aggregate function over log results, returning nil when there were no values or HAVING
+// didn't match.
+// SELECT AVG(line.duration_ms) FROM testapp WHERE date > '2016-10-05'
+func (tp *TidalwaveParser) Aggregate() *float64 {
+	row := tp.groupBy()[""]
+	if tp.Query.Having != nil {
+		if output := []byte(row.toJSON(tp.Query, true)); !tp.Query.ProcessHaving(&output) {
+			return nil
+		}
+	}
+
+	value, err := strconv.ParseFloat(row.states[0].result(), 64)
+	if err != nil {
+		return nil
+	}
+
+	return &value
+}
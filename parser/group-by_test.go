@@ -0,0 +1,225 @@
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/tidwall/gjson"
+)
+
+func TestGroupBy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// {"file":f,"line":l} for 3 files of 4 lines, where line is grouped.
+	logPaths := writeTestLogs(t, dir, 3, 4)
+	count := sqlquery.Column{Name: "count", Function: "count", GroupIdx: -1}
+	sum := sqlquery.Column{Name: "sum", Function: "sum", KeyPath: "file", GroupIdx: -1}
+
+	tests := []struct {
+		name     string
+		logPaths []string
+		query    sqlquery.QueryParams
+		want     string
+	}{
+		{
+			"grouped",
+			logPaths,
+			sqlquery.QueryParams{Limit: -1, GroupBy: []sqlquery.GroupKey{{KeyPath: "line"}}, Columns: []sqlquery.Column{
+				{Name: "line", KeyPath: "line", GroupIdx: 0}, count, sum,
+			}},
+			`[{"line":0,"count":3,"sum":3},{"line":1,"count":3,"sum":3},{"line":2,"count":3,"sum":3},{"line":3,"count":3,"sum":3}]`,
+		},
+		{
+			"filtered counts side by side",
+			logPaths,
+			sqlquery.QueryParams{Limit: -1, Columns: []sqlquery.Column{
+				{Name: "count", Function: "count", GroupIdx: -1, Filter: &sqlquery.QueryNode{
+					Param: &sqlquery.QueryParam{KeyPath: "file", Operator: "=", IsNumber: true, ValNumber: 0},
+				}},
+				{Name: "count_1", Function: "count", GroupIdx: -1, Filter: &sqlquery.QueryNode{
+					Param: &sqlquery.QueryParam{KeyPath: "line", Operator: ">", IsNumber: true, ValNumber: 0},
+				}},
+				{Name: "count_2", Function: "count", GroupIdx: -1},
+			}},
+			`[{"count":4,"count_1":9,"count_2":12}]`,
+		},
+		{
+			"no groups without log files",
+			[]string{},
+			sqlquery.QueryParams{Limit: -1, GroupBy: []sqlquery.GroupKey{{KeyPath: "line"}}, Columns: []sqlquery.Column{
+				{Name: "line", KeyPath: "line", GroupIdx: 0}, count,
+			}},
+			`[]`,
+		},
+		{
+			"single row without log files",
+			[]string{},
+			sqlquery.QueryParams{Limit: -1, Columns: []sqlquery.Column{count, sum}},
+			`[{"count":0,"sum":null}]`,
+		},
+	}
+
+	for _, test := range tests {
+		query := test.query
+		tp := TidalwaveParser{MaxParallelism: 2, LogPaths: test.logPaths, Query: &query}
+
+		done := make(chan string)
+		go func() {
+			b, _ := TableResults{sqlquery.TypeGroupBy, tp.GroupBy()}.MarshalJSON()
+			done <- string(b)
+		}()
+
+		select {
+		case got := <-done:
+			if want := `{"type":"group-by","results":` + test.want + `}`; got != want {
+				t.Errorf("%s: got %s, want %s", test.name, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: GROUP BY never returned", test.name)
+		}
+	}
+}
+
+func TestGroupByTimeZone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Montreal goes back from UTC-4 to UTC-5 at 2am on 2024-11-03, repeating the 1am hour.
+	lines := []string{
+		`{"time":"2024-11-03T07:30:00Z"}`,
+		`{"time":"2024-11-03T04:30:00Z"}`,
+		`{"msg":"no timestamp"}`,
+		`{"time":"2024-11-03T06:30:00Z"}`,
+		`{"time":"2024-11-03T05:10:00Z"}`,
+		`{"time":"2024-11-03T05:50:00Z"}`,
+	}
+	logPath := filepath.Join(dir, "00.log")
+	if err = ioutil.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	query := sqlquery.QueryParams{
+		Limit:        -1,
+		TimestampKey: "time",
+		GroupBy:      []sqlquery.GroupKey{{KeyPath: "time", TimeUnit: "hour", Location: sqlquery.LoadLocation("America/Montreal")}},
+		Columns: []sqlquery.Column{
+			{Name: "date_trunc", KeyPath: "time", GroupIdx: 0},
+			{Name: "count", Function: "count", GroupIdx: -1},
+		},
+	}
+	tp := TidalwaveParser{MaxParallelism: 2, LogPaths: []string{logPath}, Query: &query}
+
+	b, _ := TableResults{sqlquery.TypeTimeSeries, tp.GroupBy()}.MarshalJSON()
+	want := `{"type":"time-series","results":[` +
+		`{"date_trunc":"2024-11-03T00:00:00-04:00","count":1},` +
+		`{"date_trunc":"2024-11-03T01:00:00-04:00","count":2},` +
+		`{"date_trunc":"2024-11-03T01:00:00-05:00","count":1},` +
+		`{"date_trunc":"2024-11-03T02:00:00-05:00","count":1},` +
+		`{"date_trunc":null,"count":1}]}`
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
+
+func TestNumericAggregates(t *testing.T) {
+	values := []string{`5`, `"1.5"`, `-2`, `null`, `"abc"`, `true`, `10`}
+
+	tests := []struct {
+		function string
+		want     string
+		empty    string
+	}{
+		{"sum", "14.5", "null"},
+		{"avg", "3.625", "null"},
+		{"min", "-2", "null"},
+		{"max", "10", "null"},
+		{"count", "7", "0"},
+	}
+
+	for _, test := range tests {
+		column := &sqlquery.Column{Function: test.function, KeyPath: "v"}
+		if got := newAggregateState(column).result(); got != test.empty {
+			t.Errorf("%s of no values = %s, want %s", test.function, got, test.empty)
+		}
+
+		// Values are split between two states, the same as between log files, then merged.
+		state, other := newAggregateState(column), newAggregateState(column)
+		for idx, raw := range values {
+			if idx%2 == 0 {
+				state.add(gjson.Parse(raw))
+			} else {
+				other.add(gjson.Parse(raw))
+			}
+		}
+		state.merge(other)
+
+		if got := state.result(); got != test.want {
+			t.Errorf("%s of %v = %s, want %s", test.function, values, got, test.want)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// {"file":f,"line":l} for 3 files of 4 lines.
+	logPaths := writeTestLogs(t, dir, 3, 4)
+
+	tests := []struct {
+		column sqlquery.Column
+		want   string
+	}{
+		{sqlquery.Column{Name: "sum", Function: "sum", KeyPath: "line", GroupIdx: -1}, "18"},
+		{sqlquery.Column{Name: "avg", Function: "avg", KeyPath: "file", GroupIdx: -1}, "1"},
+		{sqlquery.Column{Name: "min", Function: "min", KeyPath: "line", GroupIdx: -1}, "0"},
+		{sqlquery.Column{Name: "max", Function: "max", KeyPath: "line", GroupIdx: -1}, "3"},
+		{sqlquery.Column{Name: "max", Function: "max", KeyPath: "missing", GroupIdx: -1}, "null"},
+	}
+
+	for _, test := range tests {
+		tp := TidalwaveParser{MaxParallelism: 2, LogPaths: logPaths, Query: &sqlquery.QueryParams{
+			Type:    sqlquery.TypeAggregate,
+			Limit:   -1,
+			Columns: []sqlquery.Column{test.column},
+		}}
+
+		got, _ := FloatResults{sqlquery.TypeAggregate, tp.Aggregate()}.MarshalJSON()
+		if want := `{"type":"aggregate","results":` + test.want + `}`; string(got) != want {
+			t.Errorf("%s(%s) = %s, want %s", test.column.Function, test.column.KeyPath, got, want)
+		}
+	}
+
+	// Aggregates are computed per group when grouped.
+	query := sqlquery.QueryParams{Limit: -1, GroupBy: []sqlquery.GroupKey{{KeyPath: "file"}}, Columns: []sqlquery.Column{
+		{Name: "file", KeyPath: "file", GroupIdx: 0},
+		{Name: "sum", Function: "sum", KeyPath: "line", GroupIdx: -1},
+		{Name: "avg", Function: "avg", KeyPath: "line", GroupIdx: -1},
+		{Name: "min", Function: "min", KeyPath: "line", GroupIdx: -1},
+		{Name: "max", Function: "max", KeyPath: "line", GroupIdx: -1},
+	}}
+	tp := TidalwaveParser{MaxParallelism: 2, LogPaths: logPaths, Query: &query}
+	got, _ := TableResults{sqlquery.TypeGroupBy, tp.GroupBy()}.MarshalJSON()
+	want := `{"type":"group-by","results":[` +
+		`{"file":0,"sum":6,"avg":1.5,"min":0,"max":3},` +
+		`{"file":1,"sum":6,"avg":1.5,"min":0,"max":3},` +
+		`{"file":2,"sum":6,"avg":1.5,"min":0,"max":3}]}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
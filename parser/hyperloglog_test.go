@@ -0,0 +1,56 @@
+package parser
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	// Estimates are allowed 3 standard errors of 1.04 / sqrt(2^14) away from the real count.
+	maxError := 3 * 1.04 / math.Sqrt(hllRegisters)
+
+	for _, distinct := range []int{0, 1, 10, 1000, 20000, 100000, 500000} {
+		sketch := &hyperLogLog{}
+		parts := []*hyperLogLog{{}, {}, {}}
+		for idx := 0; idx < distinct; idx++ {
+			value := `"req-` + strconv.Itoa(idx) + `"`
+			// Values are added twice, and to different parts, which must not change the estimate.
+			sketch.add(value)
+			sketch.add(value)
+			parts[idx%len(parts)].add(value)
+			parts[(idx+1)%len(parts)].add(value)
+		}
+
+		estimate := sketch.estimate()
+		if math.Abs(estimate-float64(distinct)) > maxError*float64(distinct) {
+			t.Errorf("%d distinct values estimated as %v, over %v%% away", distinct, estimate, maxError*100)
+		}
+
+		merged := &hyperLogLog{}
+		for _, part := range parts {
+			merged.merge(part)
+		}
+
+		if merged.registers != sketch.registers {
+			t.Errorf("%d distinct values merged from parts differ from a single sketch", distinct)
+		}
+	}
+}
+
+func TestApproxCountDistinctState(t *testing.T) {
+	state := &approxCountDistinctState{sketch: &hyperLogLog{}}
+	other := &approxCountDistinctState{sketch: &hyperLogLog{}}
+	for _, raw := range []string{`1`, `"1"`, `true`, `{"a":1}`} {
+		state.add(gjson.Parse(raw))
+		other.add(gjson.Parse(raw))
+	}
+	state.merge(other)
+
+	// Values of different types are counted separately, the same as COUNT(DISTINCT()).
+	if got := state.result(); got != "4" {
+		t.Errorf("approx_count_distinct of 4 distinct values returned %s", got)
+	}
+}
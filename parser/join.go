@@ -0,0 +1,237 @@
+// Package parser handles parsing log files based on the SQL execution type.
+package parser
+
+import (
+	"bytes"
+	"os"
+	"sync"
+
+	"github.com/busbud/tidalwave/logger"
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// DefaultMaxJoinMemory is the default amount of megabytes of lines a JOIN can hold in memory.
+const DefaultMaxJoinMemory = 1024
+
+// Rough amount of bytes used by each line held in memory by a JOIN, on top of the line itself.
+const joinLineOverhead = 64
+
+// joinStep looks up the lines of a joined app by the value of a key of an app that was already joined to the row.
+type joinStep struct {
+	table      int
+	parent     int
+	parentPath string
+	keyPath    string
+	lines      map[string][][]byte
+}
+
+// joinMemory tracks the size of the lines held in memory by a JOIN, closing stop once it has grown past its maximum.
+type joinMemory struct {
+	sync.Mutex
+	size     int
+	maxSize  int
+	exceeded bool
+	stop     chan struct{}
+}
+
+func (mem *joinMemory) add(step *joinStep, key string, line []byte) {
+	mem.Lock()
+	defer mem.Unlock()
+
+	if mem.exceeded {
+		return
+	}
+
+	step.lines[key] = append(step.lines[key], line)
+	mem.size += len(line) + len(key) + joinLineOverhead
+	if mem.size > mem.maxSize {
+		mem.exceeded = true
+		close(mem.stop)
+	}
+}
+
+// logPathsSize returns the total size of log files, used to pick which apps of a JOIN are held in memory.
+func logPathsSize(logPaths []string) int64 {
+	var size int64
+	for _, logPath := range logPaths {
+		if info, err := os.Stat(logPath); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+// scanLogs calls callback for every line of the log files matching a query, parsing files in parallel.
+func scanLogs(query *sqlquery.QueryParams, logPaths []string, maxParallelism int, stop <-chan struct{}, callback func(line []byte)) {
+	var wg sync.WaitGroup
+	wg.Add(len(logPaths))
+
+	coreLimit := make(chan bool, maxParallelism)
+	for _, logPath := range logPaths {
+		coreLimit <- true
+		go func(logPath string) {
+			defer wg.Done()
+
+			err := readLinesUntil(logPath, stop, func(line *[]byte) {
+				if query.ProcessLine(line) {
+					callback(bytes.TrimRight(*line, "\r\n"))
+				}
+			})
+
+			if err != nil {
+				logger.Log.Fatal(err)
+			}
+			<-coreLimit
+		}(logPath)
+	}
+
+	wg.Wait()
+}
+
+// joinPlan holds what's needed to execute a JOIN once every app but the streamed one is held in memory.
+type joinPlan struct {
+	queries  []*sqlquery.QueryParams
+	logPaths [][]string
+	probe    int // App with the largest log files, which is streamed rather then held in memory
+	steps    []*joinStep
+}
+
+// orderSteps orders the apps other then the streamed one so each is looked up by a key of an app joined before it.
+func (tp *TidalwaveParser) orderSteps(plan *joinPlan) {
+	joined := map[int]bool{plan.probe: true}
+	for len(joined) < len(plan.queries) {
+		for _, condition := range tp.Query.JoinConditions {
+			switch {
+			case joined[condition.Left] && !joined[condition.Right]:
+				plan.steps = append(plan.steps, &joinStep{condition.Right, condition.Left, condition.LeftPath, condition.RightPath, map[string][][]byte{}})
+				joined[condition.Right] = true
+			case joined[condition.Right] && !joined[condition.Left]:
+				plan.steps = append(plan.steps, &joinStep{condition.Left, condition.Right, condition.RightPath, condition.LeftPath, map[string][][]byte{}})
+				joined[condition.Left] = true
+			}
+		}
+	}
+}
+
+// buildJoin reads the log files of every app but the one with the largest log files, holding their lines in memory
+// keyed by the key of their ON condition.
+func (tp *TidalwaveParser) buildJoin() *joinPlan {
+	logRoot := viper.GetString("logroot")
+	maxMemory := viper.GetInt("max-join-memory")
+
+	plan := &joinPlan{
+		queries:  make([]*sqlquery.QueryParams, len(tp.Query.Joins)),
+		logPaths: make([][]string, len(tp.Query.Joins)),
+	}
+
+	var probeSize int64 = -1
+	for idx := range tp.Query.Joins {
+		plan.queries[idx] = tp.Query.JoinTableQuery(idx)
+		plan.logPaths[idx] = GetLogPathsForApp(plan.queries[idx], tp.Query.Joins[idx].App, logRoot)
+		logger.Log.Debugf("Join Log Paths for %s: %s", tp.Query.Joins[idx].Alias, plan.logPaths[idx])
+
+		if size := logPathsSize(plan.logPaths[idx]); size > probeSize {
+			plan.probe, probeSize = idx, size
+		}
+	}
+	tp.orderSteps(plan)
+
+	mem := &joinMemory{maxSize: maxMemory * 1024 * 1024, stop: make(chan struct{})}
+	for _, step := range plan.steps {
+		step := step
+		scanLogs(plan.queries[step.table], plan.logPaths[step.table], tp.MaxParallelism, mem.stop, func(line []byte) {
+			if key := gjson.GetBytes(line, step.keyPath); key.Type != gjson.Null {
+				mem.add(step, sqlquery.ValueKey(key), line)
+			}
+		})
+
+		if mem.exceeded {
+			logger.Log.Panicf("JOIN held more then the maximum of %d MB of lines, set by --max-join-memory", maxMemory)
+		}
+	}
+
+	return plan
+}
+
+// joinRow creates the row matched against the query, holding the line of each app under its alias.
+func (tp *TidalwaveParser) joinRow(lines [][]byte) []byte {
+	var row bytes.Buffer
+	row.WriteByte('{')
+	for idx := range lines {
+		if idx > 0 {
+			row.WriteByte(',')
+		}
+		row.WriteString(`"` + tp.Query.Joins[idx].Alias + `":`)
+		row.Write(lines[idx])
+	}
+	row.WriteByte('}')
+
+	return row.Bytes()
+}
+
+// probeJoin streams the lines of the largest app, looking up the lines of every other app joined to each of them.
+// Matching rows are passed to callback, which may be called from many goroutines.
+func (tp *TidalwaveParser) probeJoin(plan *joinPlan, stop <-chan struct{}, callback func(row []byte)) {
+	scanLogs(plan.queries[plan.probe], plan.logPaths[plan.probe], tp.MaxParallelism, stop, func(line []byte) {
+		rows := [][][]byte{make([][]byte, len(tp.Query.Joins))}
+		rows[0][plan.probe] = line
+
+		for _, step := range plan.steps {
+			joinedRows := [][][]byte{}
+			for _, row := range rows {
+				key := gjson.GetBytes(row[step.parent], step.parentPath)
+				if key.Type == gjson.Null {
+					continue
+				}
+
+				for _, match := range step.lines[sqlquery.ValueKey(key)] {
+					joinedRow := append([][]byte{}, row...)
+					joinedRow[step.table] = match
+					joinedRows = append(joinedRows, joinedRow)
+				}
+			}
+			rows = joinedRows
+		}
+
+		for _, row := range rows {
+			joinedRow := tp.joinRow(row)
+			if tp.Query.ProcessLine(&joinedRow) {
+				callback(joinedRow)
+			}
+		}
+	})
+}
+
+// JoinSearch executes a search over apps joined on a key, where rows are submitted in the order they're found.
+// SELECT a.line.msg, p.line.status FROM api a JOIN payments p ON a.line.req_id = p.line.req_id WHERE date = '2024-01-01'
+func (tp *TidalwaveParser) JoinSearch() chan []byte {
+	limit := newSearchLimit(tp.Query)
+	submitChannel := make(chan []byte, 10000)
+
+	plan := tp.buildJoin()
+	go func() {
+		tp.probeJoin(plan, limit.stop, func(row []byte) {
+			limit.submit(submitChannel, formatLine(tp.Query, row))
+		})
+		close(submitChannel)
+	}()
+
+	return submitChannel
+}
+
+// JoinCount executes a COUNT() query over apps joined on a key.
+// SELECT COUNT(*) FROM api a JOIN payments p ON a.line.req_id = p.line.req_id WHERE date = '2024-01-01'
+func (tp *TidalwaveParser) JoinCount() int {
+	var lock sync.Mutex
+	count := 0
+	tp.probeJoin(tp.buildJoin(), nil, func(row []byte) {
+		lock.Lock()
+		count++
+		lock.Unlock()
+	})
+
+	return count
+}
@@ -0,0 +1,53 @@
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/spf13/viper"
+)
+
+func TestJoinMemory(t *testing.T) {
+	logRoot, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logRoot)
+
+	writeAppLogs(t, logRoot, "api", 10)
+	writeAppLogs(t, logRoot, "payments", 5)
+	viper.Set("logroot", logRoot)
+	defer viper.Set("max-join-memory", DefaultMaxJoinMemory)
+
+	newParser := func() *TidalwaveParser {
+		return &TidalwaveParser{MaxParallelism: 2, Query: &sqlquery.QueryParams{
+			Type:           sqlquery.TypeCount,
+			Limit:          -1,
+			Joins:          []sqlquery.JoinTable{{App: "api", Alias: "a"}, {App: "payments", Alias: "p"}},
+			JoinConditions: []sqlquery.JoinCondition{{Left: 0, LeftPath: "line", Right: 1, RightPath: "line"}},
+		}}
+	}
+
+	viper.Set("max-join-memory", DefaultMaxJoinMemory)
+	if count := newParser().JoinCount(); count != 5 {
+		t.Errorf("JOIN matched %d rows, want 5", count)
+	}
+
+	// Lines of payments are held in memory, which no longer fit once the ceiling is 0 MB.
+	viper.Set("max-join-memory", 0)
+	for name, join := range map[string]func(tp *TidalwaveParser){
+		"JoinCount":  func(tp *TidalwaveParser) { tp.JoinCount() },
+		"JoinSearch": func(tp *TidalwaveParser) { tp.JoinSearch() },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s didn't raise the JOIN memory error", name)
+				}
+			}()
+			join(newParser())
+		}()
+	}
+}
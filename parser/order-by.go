@@ -0,0 +1,469 @@
+// Package parser handles parsing log files based on the SQL execution type.
+package parser
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/busbud/tidalwave/logger"
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/tidwall/gjson"
+)
+
+// Amount of rows each worker holds in memory before sorting and spilling them to a temporary file. Rows left once
+// workers are done parsing are kept in memory for the merge up to the same amount across every worker.
+var sortChunkSize = 100000
+
+// Amount of spilled files opened at once when merging. When more files were spilled they're merged in rounds, each
+// merging this many files in to a single new one, to stay well under the limit of open files.
+var maxMergeFiles = 64
+
+// sortRow is a matched line along with the values of the query's ORDER BY keys.
+type sortRow struct {
+	keys []gjson.Result
+	line []byte
+}
+
+// typeRank orders values of different JSON types. Missing keys and nulls are ranked last, which matches Postgres'
+// default of NULLS LAST for ascending and NULLS FIRST for descending orders.
+func typeRank(value gjson.Result) int {
+	switch value.Type {
+	case gjson.Number:
+		return 0
+	case gjson.String:
+		return 1
+	case gjson.False, gjson.True, gjson.JSON:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// compareValues returns -1, 0, or 1 when a is less, equal, or greater then b.
+func compareValues(a, b gjson.Result) int {
+	rankA, rankB := typeRank(a), typeRank(b)
+	switch {
+	case rankA < rankB:
+		return -1
+	case rankA > rankB:
+		return 1
+	}
+
+	switch a.Type {
+	case gjson.Number:
+		switch {
+		case a.Num < b.Num:
+			return -1
+		case a.Num > b.Num:
+			return 1
+		}
+		return 0
+	case gjson.String:
+		return strings.Compare(a.Str, b.Str)
+	default:
+		return strings.Compare(a.Raw, b.Raw)
+	}
+}
+
+// lessRow returns true if a is sorted before b by the query's ORDER BY clause.
+func lessRow(orderBy []sqlquery.OrderParam, a, b *sortRow) bool {
+	for idx := range orderBy {
+		cmp := compareValues(a.keys[idx], b.keys[idx])
+		if orderBy[idx].Desc {
+			cmp = -cmp
+		}
+
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+
+	return false
+}
+
+// topHeap keeps the best N rows seen for ORDER BY ... LIMIT N queries, with the worst row at the top so it can be
+// evicted when a better row is found.
+type topHeap struct {
+	orderBy []sqlquery.OrderParam
+	rows    []*sortRow
+}
+
+func (h *topHeap) Len() int           { return len(h.rows) }
+func (h *topHeap) Less(i, j int) bool { return lessRow(h.orderBy, h.rows[j], h.rows[i]) }
+func (h *topHeap) Swap(i, j int)      { h.rows[i], h.rows[j] = h.rows[j], h.rows[i] }
+
+func (h *topHeap) Push(x interface{}) {
+	h.rows = append(h.rows, x.(*sortRow))
+}
+
+func (h *topHeap) Pop() interface{} {
+	row := h.rows[len(h.rows)-1]
+	h.rows = h.rows[:len(h.rows)-1]
+	return row
+}
+
+// add pushes a row on to the heap, evicting the worst row once the heap holds more then size rows.
+func (h *topHeap) add(row *sortRow, size int) {
+	if len(h.rows) >= size {
+		if size == 0 || !lessRow(h.orderBy, row, h.rows[0]) {
+			return
+		}
+		h.rows[0] = row
+		heap.Fix(h, 0)
+		return
+	}
+
+	heap.Push(h, row)
+}
+
+// sortMemory counts the rows workers kept in memory once they were done parsing, so the rows held until the merge
+// are bounded no matter how many log files are read.
+type sortMemory struct {
+	sync.Mutex
+	rows int
+}
+
+// reserve returns true if size more rows can be kept in memory, otherwise they need to be spilled.
+func (mem *sortMemory) reserve(size int) bool {
+	mem.Lock()
+	defer mem.Unlock()
+
+	if mem.rows+size > sortChunkSize {
+		return false
+	}
+
+	mem.rows += size
+	return true
+}
+
+// sortRun holds the sorted rows of a single worker, kept either in memory or in temporary files.
+type sortRun struct {
+	chunks    [][]*sortRow
+	spillPath []string
+}
+
+func writeUvarintBytes(writer *bufio.Writer, data []byte) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	if _, err := writer.Write(buf[:binary.PutUvarint(buf, uint64(len(data)))]); err != nil {
+		return err
+	}
+
+	_, err := writer.Write(data)
+	return err
+}
+
+func readUvarintBytes(reader *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	return data, err
+}
+
+// spillRows writes sorted rows to a temporary file, returning its path.
+func spillRows(rows []*sortRow) (string, error) {
+	return writeRows(func() *sortRow {
+		if len(rows) == 0 {
+			return nil
+		}
+
+		row := rows[0]
+		rows = rows[1:]
+		return row
+	})
+}
+
+// writeRows writes the rows returned by next to a temporary file until it returns nil, returning the file's path.
+func writeRows(next func() *sortRow) (string, error) {
+	file, err := ioutil.TempFile("", "tidalwave-sort-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close() //nolint:errcheck // Don't care if there's errors.
+
+	writer := bufio.NewWriter(file)
+	for row := next(); row != nil; row = next() {
+		for idx := range row.keys {
+			if err = writeUvarintBytes(writer, []byte(row.keys[idx].Raw)); err != nil {
+				return file.Name(), err
+			}
+		}
+
+		if err = writeUvarintBytes(writer, row.line); err != nil {
+			return file.Name(), err
+		}
+	}
+
+	return file.Name(), writer.Flush()
+}
+
+// rowIterator reads sorted rows back from either memory or a spilled file.
+type rowIterator struct {
+	keysLen int
+	rows    []*sortRow
+	reader  *bufio.Reader
+	file    *os.File
+}
+
+// close closes and removes the iterator's spilled file, if it has one.
+func (it *rowIterator) close() {
+	if it.file == nil {
+		return
+	}
+
+	it.file.Close()           //nolint:errcheck,gosec // Don't care if there's errors.
+	os.Remove(it.file.Name()) //nolint:errcheck,gosec // Don't care if there's errors.
+	it.file = nil
+	it.reader = nil
+}
+
+// next returns the iterator's next row, or nil once every row has been read. Spilled files are closed and removed
+// as soon as they've been read.
+func (it *rowIterator) next() *sortRow {
+	if it.reader == nil {
+		if len(it.rows) == 0 {
+			return nil
+		}
+
+		row := it.rows[0]
+		it.rows = it.rows[1:]
+		return row
+	}
+
+	row := &sortRow{keys: make([]gjson.Result, it.keysLen)}
+	for idx := range row.keys {
+		raw, err := readUvarintBytes(it.reader)
+		if err == io.EOF {
+			it.close()
+			return nil
+		}
+		if err != nil {
+			logger.Log.Fatal(err)
+		}
+
+		row.keys[idx] = gjson.ParseBytes(raw)
+	}
+
+	line, err := readUvarintBytes(it.reader)
+	if err != nil {
+		logger.Log.Fatal(err)
+	}
+	row.line = line
+
+	return row
+}
+
+// mergeHeap merges the sorted rows of many iterators, with the next row to submit at the top.
+type mergeHeap struct {
+	orderBy   []sqlquery.OrderParam
+	rows      []*sortRow
+	iterators []*rowIterator
+}
+
+func (h *mergeHeap) Len() int { return len(h.rows) }
+func (h *mergeHeap) Less(i, j int) bool {
+	return lessRow(h.orderBy, h.rows[i], h.rows[j])
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.rows[i], h.rows[j] = h.rows[j], h.rows[i]
+	h.iterators[i], h.iterators[j] = h.iterators[j], h.iterators[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	it := x.(*rowIterator)
+	if row := it.next(); row != nil {
+		h.rows = append(h.rows, row)
+		h.iterators = append(h.iterators, it)
+	}
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	last := len(h.rows) - 1
+	it := h.iterators[last]
+	h.rows = h.rows[:last]
+	h.iterators = h.iterators[:last]
+	return it
+}
+
+// openSpill opens a spilled file for the merge.
+func openSpill(keysLen int, spillPath string) *rowIterator {
+	file, err := os.Open(spillPath)
+	if err != nil {
+		logger.Log.Fatal(err)
+	}
+
+	return &rowIterator{keysLen: keysLen, reader: bufio.NewReader(file), file: file}
+}
+
+// mergeSpills merges sorted spilled files in to a single new one, removing them once they've been read.
+func mergeSpills(orderBy []sqlquery.OrderParam, spillPaths []string) (string, error) {
+	merge := &mergeHeap{orderBy: orderBy}
+	for _, spillPath := range spillPaths {
+		heap.Push(merge, openSpill(len(orderBy), spillPath))
+	}
+
+	return writeRows(func() *sortRow {
+		if merge.Len() == 0 {
+			return nil
+		}
+
+		row := merge.rows[0]
+		heap.Push(merge, heap.Pop(merge))
+		return row
+	})
+}
+
+// reduceSpills merges spilled files in rounds of maxMergeFiles until no more then maxMergeFiles are left, which are
+// opened together by the final merge.
+func reduceSpills(orderBy []sqlquery.OrderParam, spillPaths []string) []string {
+	for len(spillPaths) > maxMergeFiles {
+		merged, err := mergeSpills(orderBy, spillPaths[:maxMergeFiles])
+		if merged != "" {
+			spillPaths = append(spillPaths[maxMergeFiles:], merged)
+		}
+		if err != nil {
+			logger.Log.Fatal(err)
+		}
+	}
+
+	return spillPaths
+}
+
+func newSortRow(query *sqlquery.QueryParams, line []byte) *sortRow {
+	row := &sortRow{keys: make([]gjson.Result, len(query.OrderBy)), line: formatLine(query, line)}
+	for idx := range query.OrderBy {
+		row.keys[idx] = gjson.GetBytes(line, query.OrderBy[idx].KeyPath)
+	}
+
+	return row
+}
+
+func orderByParse(query *sqlquery.QueryParams, logPath string, topSize int, mem *sortMemory, resultsChan chan<- sortRun, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	run := sortRun{}
+	top := &topHeap{orderBy: query.OrderBy}
+	rows := []*sortRow{}
+
+	spill := func() {
+		sort.SliceStable(rows, func(i, j int) bool { return lessRow(query.OrderBy, rows[i], rows[j]) })
+		spillPath, err := spillRows(rows)
+		if spillPath != "" {
+			run.spillPath = append(run.spillPath, spillPath)
+		}
+		if err != nil {
+			logger.Log.Fatal(err)
+		}
+		rows = []*sortRow{}
+	}
+
+	err := readLines(logPath, func(line *[]byte) {
+		if !query.ProcessLine(line) {
+			return
+		}
+
+		row := newSortRow(query, *line)
+		if topSize >= 0 {
+			top.add(row, topSize)
+			return
+		}
+
+		rows = append(rows, row)
+		if len(rows) >= sortChunkSize {
+			spill()
+		}
+	})
+
+	if err != nil {
+		logger.Log.Fatal(err)
+	}
+
+	switch {
+	case topSize >= 0:
+		rows = top.rows
+	case len(rows) > 0 && !mem.reserve(len(rows)):
+		spill()
+	}
+
+	if len(rows) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool { return lessRow(query.OrderBy, rows[i], rows[j]) })
+		run.chunks = append(run.chunks, rows)
+	}
+
+	resultsChan <- run
+}
+
+// orderedSearch executes a search query with an ORDER BY clause. With a LIMIT each worker only keeps its best rows in
+// a bounded heap, otherwise rows are sorted in chunks that are spilled to temporary files and merged back together.
+// SELECT * FROM serverapp, clientapp WHERE date = '2016-10-05' ORDER BY line.duration_ms DESC LIMIT 10
+func (tp *TidalwaveParser) orderedSearch() chan []byte {
+	logsLen := len(tp.LogPaths)
+	topSize := -1
+	if tp.Query.Limit >= 0 {
+		topSize = tp.Query.Offset + tp.Query.Limit
+	}
+
+	submitChannel := make(chan []byte, 10000)
+	go func() {
+		resultsChan := make(chan sortRun, logsLen)
+
+		var wg sync.WaitGroup
+		wg.Add(logsLen)
+
+		mem := &sortMemory{}
+		coreLimit := make(chan bool, tp.MaxParallelism)
+		for i := 0; i < logsLen; i++ {
+			coreLimit <- true
+			go func(logPath string) {
+				orderByParse(tp.Query, logPath, topSize, mem, resultsChan, &wg)
+				<-coreLimit
+			}(tp.LogPaths[i])
+		}
+
+		wg.Wait()
+		close(resultsChan)
+
+		merge := &mergeHeap{orderBy: tp.Query.OrderBy}
+		spillPaths := []string{}
+		for run := range resultsChan {
+			for _, rows := range run.chunks {
+				heap.Push(merge, &rowIterator{rows: rows})
+			}
+			spillPaths = append(spillPaths, run.spillPath...)
+		}
+
+		for _, spillPath := range reduceSpills(tp.Query.OrderBy, spillPaths) {
+			heap.Push(merge, openSpill(len(tp.Query.OrderBy), spillPath))
+		}
+
+		limit := newSearchLimit(tp.Query)
+		for merge.Len() > 0 {
+			row := merge.rows[0]
+			if !limit.submit(submitChannel, row.line) {
+				break
+			}
+
+			heap.Push(merge, heap.Pop(merge))
+		}
+
+		// Iterators that were read to the end already removed their files.
+		for _, it := range merge.iterators {
+			it.close()
+		}
+
+		close(submitChannel)
+	}()
+
+	return submitChannel
+}
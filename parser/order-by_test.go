@@ -0,0 +1,192 @@
+package parser
+
+import (
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/busbud/tidalwave/logger"
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/tidwall/gjson"
+)
+
+func init() { logger.Init(false) }
+
+// writeTestLogs writes log files holding {"file":f,"line":l} for each line, returning their paths.
+func writeTestLogs(t *testing.T, dir string, files, lines int) []string {
+	logPaths := []string{}
+	for f := 0; f < files; f++ {
+		var body strings.Builder
+		for l := 0; l < lines; l++ {
+			fmt.Fprintf(&body, `{"file":%d,"line":%d}`+"\n", f, l)
+		}
+
+		logPath := filepath.Join(dir, fmt.Sprintf("%02d.log", f))
+		if err := ioutil.WriteFile(logPath, []byte(body.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		logPaths = append(logPaths, logPath)
+	}
+
+	return logPaths
+}
+
+func openFiles(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("Open files can't be listed on this platform")
+	}
+
+	return len(fds)
+}
+
+func TestOrderedSearchSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Spilled files are created in TMPDIR, which is checked for leftover files once the search is done.
+	tmpDir := filepath.Join(dir, "tmp")
+	if err = os.Mkdir(tmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmpDir)
+
+	defer func(size int) { sortChunkSize = size }(sortChunkSize)
+	sortChunkSize = 3
+
+	// Each file spills 3 chunks, which are merged 2 at a time.
+	defer func(files int) { maxMergeFiles = files }(maxMergeFiles)
+	maxMergeFiles = 2
+
+	logPaths := writeTestLogs(t, dir, 4, 10)
+
+	tests := []struct {
+		limit  int
+		offset int
+		want   int
+	}{
+		{-1, 0, 40},
+		{5, 2, 5},
+		{-1, 38, 2},
+	}
+
+	for _, test := range tests {
+		before := openFiles(t)
+		tp := TidalwaveParser{MaxParallelism: 2, LogPaths: logPaths, Query: &sqlquery.QueryParams{
+			Limit:   test.limit,
+			Offset:  test.offset,
+			OrderBy: []sqlquery.OrderParam{{KeyPath: "line", Desc: true}, {KeyPath: "file"}},
+		}}
+
+		rows := []string{}
+		for line := range tp.orderedSearch() {
+			rows = append(rows, strings.TrimSpace(string(line)))
+		}
+
+		if len(rows) != test.want {
+			t.Fatalf("LIMIT %d OFFSET %d returned %d rows, want %d", test.limit, test.offset, len(rows), test.want)
+		}
+
+		for idx, row := range rows {
+			position := test.offset + idx
+			want := fmt.Sprintf(`{"file":%d,"line":%d}`, position%4, 9-position/4)
+			if row != want {
+				t.Fatalf("LIMIT %d OFFSET %d row %d = %s, want %s", test.limit, test.offset, idx, row, want)
+			}
+			if !gjson.Valid(row) {
+				t.Fatalf("row %d is not valid JSON: %s", idx, row)
+			}
+		}
+
+		if after := openFiles(t); after > before {
+			t.Errorf("LIMIT %d OFFSET %d left %d files open", test.limit, test.offset, after-before)
+		}
+		if leftover, _ := filepath.Glob(filepath.Join(tmpDir, "tidalwave-sort-*")); len(leftover) > 0 {
+			t.Errorf("LIMIT %d OFFSET %d left spilled files %v", test.limit, test.offset, leftover)
+		}
+	}
+}
+
+// Spilled files are merged in rounds until few enough are left to be opened together.
+func TestReduceSpills(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmpDir)
+
+	defer func(files int) { maxMergeFiles = files }(maxMergeFiles)
+	maxMergeFiles = 3
+
+	// 7 files holding the numbers 0 to 69, where file f holds f, f+7, f+14...
+	orderBy := []sqlquery.OrderParam{{KeyPath: "n"}}
+	spillPaths := []string{}
+	for f := 0; f < 7; f++ {
+		rows := []*sortRow{}
+		for n := f; n < 70; n += 7 {
+			line := []byte(fmt.Sprintf(`{"n":%d}`, n))
+			rows = append(rows, &sortRow{keys: []gjson.Result{gjson.GetBytes(line, "n")}, line: line})
+		}
+
+		spillPath, err := spillRows(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spillPaths = append(spillPaths, spillPath)
+	}
+
+	before := openFiles(t)
+	spillPaths = reduceSpills(orderBy, spillPaths)
+	if len(spillPaths) > maxMergeFiles {
+		t.Fatalf("%d files left to merge, want at most %d", len(spillPaths), maxMergeFiles)
+	}
+	if after := openFiles(t); after > before {
+		t.Errorf("merging left %d files open", after-before)
+	}
+	if left, _ := filepath.Glob(filepath.Join(tmpDir, "tidalwave-sort-*")); len(left) != len(spillPaths) {
+		t.Errorf("merged files weren't removed, %d files left for %d paths", len(left), len(spillPaths))
+	}
+
+	merge := &mergeHeap{orderBy: orderBy}
+	for _, spillPath := range spillPaths {
+		heap.Push(merge, openSpill(len(orderBy), spillPath))
+	}
+	for n := 0; n < 70; n++ {
+		if merge.Len() == 0 {
+			t.Fatalf("merge ended after %d rows, want 70", n)
+		}
+		if want := fmt.Sprintf(`{"n":%d}`, n); string(merge.rows[0].line) != want {
+			t.Fatalf("row %d = %s, want %s", n, merge.rows[0].line, want)
+		}
+		heap.Push(merge, heap.Pop(merge))
+	}
+	if merge.Len() != 0 {
+		t.Errorf("merge returned more then 70 rows")
+	}
+}
+
+// Rows left once workers are done parsing are kept in memory up to sortChunkSize across every worker.
+func TestSortMemory(t *testing.T) {
+	defer func(size int) { sortChunkSize = size }(sortChunkSize)
+	sortChunkSize = 10
+
+	mem := &sortMemory{}
+	for _, test := range []struct {
+		size int
+		want bool
+	}{{4, true}, {4, true}, {3, false}, {2, true}, {1, false}} {
+		if got := mem.reserve(test.size); got != test.want {
+			t.Fatalf("reserve(%d) with %d rows held = %v, want %v", test.size, mem.rows, got, test.want)
+		}
+	}
+}
@@ -3,10 +3,12 @@ package parser
 
 import (
 	"bufio"
+	"encoding/json"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,6 +20,7 @@ import (
 
 const (
 	fileDateFormat   = "YYYY-MM-DDTHH-mm-ss"
+	fileDateLayout   = "2006-01-02T15-04-05" // Same as fileDateFormat, for use with the time package
 	folderDateFormat = "YYYY-MM-DD"
 )
 
@@ -55,7 +58,26 @@ type ObjectResults struct {
 	Results *map[string]int `json:"results"`
 }
 
+// FloatResults does stuff
+//easyjson:json
+type FloatResults struct {
+	Type    string   `json:"type"`
+	Results *float64 `json:"results"`
+}
+
+// TableResults returns rows of JSON objects
+//easyjson:json
+type TableResults struct {
+	Type    string             `json:"type"`
+	Results *[]json.RawMessage `json:"results"`
+}
+
 func readLines(logPath string, callback func(*[]byte)) error {
+	return readLinesUntil(logPath, nil, callback)
+}
+
+// readLinesUntil is the same as readLines, but stops reading the file early once stop is closed.
+func readLinesUntil(logPath string, stop <-chan struct{}, callback func(*[]byte)) error {
 	var err error
 
 	maxAttemptes := 5
@@ -98,16 +120,42 @@ func readLines(logPath string, callback func(*[]byte)) error {
 				}
 			}
 
-			callback(&line)
+			select {
+			case <-stop:
+				return nil
+			default:
+				callback(&line)
+			}
 		}
 	}
 
 	return err
 }
 
-func dateMatch(date *moment.Moment, dates []sqlquery.DateParam, dateOnly bool) bool {
+// limitKeys applies a query's OFFSET and LIMIT to a sorted list of keys.
+func limitKeys(query *sqlquery.QueryParams, keys []string) []string {
+	if query.Offset >= len(keys) {
+		return []string{}
+	}
+
+	keys = keys[query.Offset:]
+	if query.Limit >= 0 && query.Limit < len(keys) {
+		keys = keys[:query.Limit]
+	}
+
+	return keys
+}
+
+// dateMatch returns true if a folder or log file matches every date in the query. Log files hold an hour of logs,
+// where dateEnd is the last second of the hour so a file matches a date after any time within it.
+func dateMatch(date, dateEnd *moment.Moment, dates []sqlquery.DateParam, dateOnly bool) bool {
 	for idx := range dates {
-		if !sqlquery.ProcessDate(&dates[idx], *date, dateOnly) {
+		compareDate := date
+		if dates[idx].Operator == ">" || dates[idx].Operator == ">=" {
+			compareDate = dateEnd
+		}
+
+		if !sqlquery.ProcessDate(&dates[idx], *compareDate, dateOnly) {
 			return false
 		}
 	}
@@ -115,20 +163,35 @@ func dateMatch(date *moment.Moment, dates []sqlquery.DateParam, dateOnly bool) b
 	return true
 }
 
+// fileEndDate returns the date of the last second of an hourly log file.
+func fileEndDate(fileDate string) *moment.Moment {
+	if t, err := time.Parse(fileDateLayout, fileDate); err == nil {
+		fileDate = t.Add(time.Hour - time.Second).Format(fileDateLayout)
+	}
+
+	return moment.New().Moment(fileDateFormat, fileDate)
+}
+
 // GetLogPathsForApp returns all log paths matching a query for a specified app
 func GetLogPathsForApp(query *sqlquery.QueryParams, appName, logRoot string) []string {
+	// WITH queries are read from the temporary log file holding their results.
+	if with := query.WithQuery(appName); with != nil {
+		return []string{with.LogPath}
+	}
+
 	var logPaths []string
 	folderGlob, _ := filepath.Glob(path.Join(logRoot, appName+"/*/"))
 
 	// TODO This can be optimized for single date queries.
 	for _, folderPath := range folderGlob {
 		folderDate := moment.New().Moment(folderDateFormat, path.Base(folderPath))
-		if dateMatch(folderDate, query.Dates, true) {
+		if dateMatch(folderDate, folderDate, query.Dates, true) {
 			globLogs, _ := filepath.Glob(path.Join(folderPath, "/*.log"))
 
 			for _, filename := range globLogs {
-				logDate := moment.New().Moment(fileDateFormat, strings.TrimSuffix(path.Base(filename), filepath.Ext(filename)))
-				if dateMatch(logDate, query.Dates, false) {
+				fileDate := strings.TrimSuffix(path.Base(filename), filepath.Ext(filename))
+				logDate := moment.New().Moment(fileDateFormat, fileDate)
+				if dateMatch(logDate, fileEndDate(fileDate), query.Dates, false) {
 					logPaths = append(logPaths, filename)
 				}
 			}
@@ -138,19 +201,41 @@ func GetLogPathsForApp(query *sqlquery.QueryParams, appName, logRoot string) []s
 	return logPaths
 }
 
-// GetLogPaths returns all log paths matching a query
+// GetLogPaths returns all log paths matching a query. Paths from multiple applications are interleaved by hour, keeping
+// the order of the FROM clause for files of the same hour.
 func GetLogPaths(query *sqlquery.QueryParams, logRoot string) []string {
 	var logPaths []string
 	for _, appName := range query.From {
 		logPaths = append(logPaths, GetLogPathsForApp(query, appName, logRoot)...)
 	}
 
+	if len(query.From) > 1 {
+		sort.SliceStable(logPaths, func(i, j int) bool {
+			return path.Base(logPaths[i]) < path.Base(logPaths[j])
+		})
+	}
+
 	return logPaths
 }
 
 // Query executes a given query string.
 func Query(queryString string) interface{} {
-	query := sqlquery.New(queryString)
+	return executeWithQueries(sqlquery.New(queryString))
+}
+
+// executeWithQueries runs a parsed query along with its WITH queries, removing their temporary log files once the
+// results have been read or as soon as the query fails.
+func executeWithQueries(query *sqlquery.QueryParams) interface{} {
+	withPaths := materializeWithQueries(query)
+	defer removeOnPanic(&withPaths)
+
+	return removeAfterResults(execute(query), withPaths)
+}
+
+// execute runs a parsed query with the parser of its type.
+func execute(query *sqlquery.QueryParams) interface{} {
+	resolveSubqueries(query, viper.GetString("logroot"), viper.GetInt("max-parallelism"), viper.GetInt("max-subquery-memory"))
+
 	logPaths := GetLogPaths(query, viper.GetString("logroot"))
 	parser := TidalwaveParser{
 		MaxParallelism: viper.GetInt("max-parallelism"),
@@ -160,10 +245,20 @@ func Query(queryString string) interface{} {
 
 	logger.Log.Debugf("Log Paths: %s", logPaths)
 
+	if len(query.Joins) > 0 {
+		if query.Type == sqlquery.TypeCount {
+			return IntResults{sqlquery.TypeCount, parser.JoinCount()}
+		}
+		return ChannelResults{sqlquery.TypeSearch, parser.JoinSearch()}
+	}
+
 	// TODO: Add execution time to results.
 	// TODO: Need to handle nil.
 	switch query.Type {
 	case sqlquery.TypeCountDistinct:
+		if len(query.OrderBy) > 0 {
+			return TableResults{sqlquery.TypeCountDistinct, parser.CountDistinctRows()}
+		}
 		return ObjectResults{sqlquery.TypeCountDistinct, parser.CountDistinct()}
 	case sqlquery.TypeDistinct:
 		return ArrayResults{sqlquery.TypeDistinct, parser.Distinct()}
@@ -171,6 +266,14 @@ func Query(queryString string) interface{} {
 		return IntResults{sqlquery.TypeCount, parser.Count()}
 	case sqlquery.TypeSearch:
 		return ChannelResults{sqlquery.TypeSearch, parser.Search()}
+	case sqlquery.TypeGroupBy:
+		return TableResults{sqlquery.TypeGroupBy, parser.GroupBy()}
+	case sqlquery.TypeTimeSeries:
+		return TableResults{sqlquery.TypeTimeSeries, parser.GroupBy()}
+	case sqlquery.TypeAggregate:
+		return FloatResults{sqlquery.TypeAggregate, parser.Aggregate()}
+	case sqlquery.TypeUnion:
+		return ChannelResults{sqlquery.TypeUnion, parser.Union()}
 	default:
 		return nil
 	}
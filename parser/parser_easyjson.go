@@ -356,3 +356,227 @@ func (v *ArrayResults) UnmarshalJSON(data []byte) error {
 func (v *ArrayResults) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonF59a38b1DecodeGithubCombusbudTidalwaveParser2(l, v)
 }
+func easyjsonF59a38b1DecodeGithubCombusbudTidalwaveParser3(in *jlexer.Lexer, out *TableResults) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "type":
+			out.Type = string(in.String())
+		case "results":
+			if in.IsNull() {
+				in.Skip()
+				out.Results = nil
+			} else {
+				if out.Results == nil {
+					out.Results = new([]json.RawMessage)
+				}
+				if in.IsNull() {
+					in.Skip()
+					*out.Results = nil
+				} else {
+					in.Delim('[')
+					if *out.Results == nil {
+						if !in.IsDelim(']') {
+							*out.Results = make([]json.RawMessage, 0, 2)
+						} else {
+							*out.Results = []json.RawMessage{}
+						}
+					} else {
+						*out.Results = (*out.Results)[:0]
+					}
+					for !in.IsDelim(']') {
+						var v6 json.RawMessage
+						if data := in.Raw(); in.Ok() {
+							in.AddError((v6).UnmarshalJSON(data))
+						}
+						*out.Results = append(*out.Results, v6)
+						in.WantComma()
+					}
+					in.Delim(']')
+				}
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonF59a38b1EncodeGithubCombusbudTidalwaveParser3(out *jwriter.Writer, in TableResults) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"type\":"
+		if first {
+			first = false
+			out.RawString(prefix[1:])
+		} else {
+			out.RawString(prefix)
+		}
+		out.String(string(in.Type))
+	}
+	{
+		const prefix string = ",\"results\":"
+		if first {
+			first = false
+			out.RawString(prefix[1:])
+		} else {
+			out.RawString(prefix)
+		}
+		if in.Results == nil {
+			out.RawString("null")
+		} else {
+			if *in.Results == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+				out.RawString("null")
+			} else {
+				out.RawByte('[')
+				for v7, v8 := range *in.Results {
+					if v7 > 0 {
+						out.RawByte(',')
+					}
+					out.Raw((v8).MarshalJSON())
+				}
+				out.RawByte(']')
+			}
+		}
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v TableResults) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonF59a38b1EncodeGithubCombusbudTidalwaveParser3(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v TableResults) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonF59a38b1EncodeGithubCombusbudTidalwaveParser3(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *TableResults) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonF59a38b1DecodeGithubCombusbudTidalwaveParser3(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *TableResults) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonF59a38b1DecodeGithubCombusbudTidalwaveParser3(l, v)
+}
+func easyjsonF59a38b1DecodeGithubCombusbudTidalwaveParser4(in *jlexer.Lexer, out *FloatResults) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "type":
+			out.Type = string(in.String())
+		case "results":
+			if in.IsNull() {
+				in.Skip()
+				out.Results = nil
+			} else {
+				if out.Results == nil {
+					out.Results = new(float64)
+				}
+				*out.Results = float64(in.Float64())
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonF59a38b1EncodeGithubCombusbudTidalwaveParser4(out *jwriter.Writer, in FloatResults) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"type\":"
+		if first {
+			first = false
+			out.RawString(prefix[1:])
+		} else {
+			out.RawString(prefix)
+		}
+		out.String(string(in.Type))
+	}
+	{
+		const prefix string = ",\"results\":"
+		if first {
+			first = false
+			out.RawString(prefix[1:])
+		} else {
+			out.RawString(prefix)
+		}
+		if in.Results == nil {
+			out.RawString("null")
+		} else {
+			out.Float64(float64(*in.Results))
+		}
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v FloatResults) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonF59a38b1EncodeGithubCombusbudTidalwaveParser4(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v FloatResults) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonF59a38b1EncodeGithubCombusbudTidalwaveParser4(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *FloatResults) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonF59a38b1DecodeGithubCombusbudTidalwaveParser4(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *FloatResults) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonF59a38b1DecodeGithubCombusbudTidalwaveParser4(l, v)
+}
@@ -0,0 +1,159 @@
+// Package parser handles parsing log files based on the SQL execution type.
+package parser
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Relative accuracy of percentiles returned by quantileSketch.
+const sketchAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// quantileSketch counts values in logarithmically sized buckets so percentiles can be estimated within
+// sketchAccuracy of the real value. The amount of buckets only grows with the range of values rather then the amount
+// of lines, and sketches from different log files are merged by adding their bucket counts together.
+type quantileSketch struct {
+	count    int
+	negative map[int]int
+	positive map[int]int
+	zeros    int
+}
+
+func newQuantileSketch() *quantileSketch {
+	return &quantileSketch{negative: map[int]int{}, positive: map[int]int{}}
+}
+
+func sketchIndex(value float64) int {
+	return int(math.Ceil(math.Log(value) / sketchLogGamma))
+}
+
+func sketchValue(index int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+}
+
+func (s *quantileSketch) add(value float64) {
+	s.count++
+	switch {
+	case value > 0:
+		s.positive[sketchIndex(value)]++
+	case value < 0:
+		s.negative[sketchIndex(-value)]++
+	default:
+		s.zeros++
+	}
+}
+
+func (s *quantileSketch) merge(other *quantileSketch) {
+	s.count += other.count
+	s.zeros += other.zeros
+	for idx, count := range other.positive {
+		s.positive[idx] += count
+	}
+	for idx, count := range other.negative {
+		s.negative[idx] += count
+	}
+}
+
+func sortedIndexes(buckets map[int]int, reverse bool) []int {
+	indexes := make([]int, 0, len(buckets))
+	for idx := range buckets {
+		indexes = append(indexes, idx)
+	}
+
+	if reverse {
+		sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+	} else {
+		sort.Ints(indexes)
+	}
+
+	return indexes
+}
+
+// quantile returns the estimated value at percentile q, where q is between 0 and 1.
+func (s *quantileSketch) quantile(q float64) float64 {
+	rank := q * float64(s.count-1)
+	seen := 0
+
+	// Negative values are stored by their absolute value, so the largest index is the smallest value.
+	for _, idx := range sortedIndexes(s.negative, true) {
+		seen += s.negative[idx]
+		if float64(seen) > rank {
+			return -sketchValue(idx)
+		}
+	}
+
+	seen += s.zeros
+	if float64(seen) > rank {
+		return 0
+	}
+
+	indexes := sortedIndexes(s.positive, false)
+	for _, idx := range indexes {
+		seen += s.positive[idx]
+		if float64(seen) > rank {
+			return sketchValue(idx)
+		}
+	}
+
+	return sketchValue(indexes[len(indexes)-1])
+}
+
+type percentileState struct {
+	percentile float64
+	sketch     *quantileSketch
+}
+
+func (s *percentileState) add(value gjson.Result) {
+	if f, ok := toFloat(value); ok {
+		s.sketch.add(f)
+	}
+}
+
+func (s *percentileState) merge(other aggregateState) {
+	s.sketch.merge(other.(*percentileState).sketch)
+}
+
+func (s *percentileState) result() string {
+	if s.sketch.count == 0 {
+		return "null"
+	}
+
+	return formatFloat(s.sketch.quantile(s.percentile))
+}
+
+// histogramState counts values in fixed width buckets.
+type histogramState struct {
+	buckets map[int]int
+	width   float64
+}
+
+func (s *histogramState) add(value gjson.Result) {
+	if f, ok := toFloat(value); ok {
+		s.buckets[int(math.Floor(f/s.width))]++
+	}
+}
+
+func (s *histogramState) merge(other aggregateState) {
+	for idx, count := range other.(*histogramState).buckets {
+		s.buckets[idx] += count
+	}
+}
+
+// result returns the buckets in order, where each bucket holds the count of values from bucket up to bucket + width.
+func (s *histogramState) result() string {
+	entries := []string{}
+	for _, idx := range sortedIndexes(s.buckets, false) {
+		entries = append(entries, `{"bucket":`+formatFloat(float64(idx)*s.width)+`,"count":`+strconv.Itoa(s.buckets[idx])+`}`)
+	}
+
+	return "[" + strings.Join(entries, ",") + "]"
+}
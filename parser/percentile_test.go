@@ -0,0 +1,51 @@
+package parser
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestQuantileSketch(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	values := make([]float64, 10000)
+	for idx := range values {
+		// Durations spread over several orders of magnitude, with some negative values and zeros.
+		switch idx % 20 {
+		case 0:
+			values[idx] = 0
+		case 1:
+			values[idx] = -random.ExpFloat64() * 10
+		default:
+			values[idx] = random.ExpFloat64() * 100
+		}
+	}
+
+	sketch := newQuantileSketch()
+	parts := []*quantileSketch{newQuantileSketch(), newQuantileSketch(), newQuantileSketch()}
+	for idx, value := range values {
+		sketch.add(value)
+		parts[idx%len(parts)].add(value)
+	}
+
+	merged := newQuantileSketch()
+	for _, part := range parts {
+		merged.merge(part)
+	}
+
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	for _, q := range []float64{0, 0.01, 0.05, 0.25, 0.5, 0.9, 0.99, 0.999, 1} {
+		want := sorted[int(q*float64(len(sorted)-1))]
+		got := sketch.quantile(q)
+		if math.Abs(got-want) > sketchAccuracy*math.Abs(want) {
+			t.Errorf("quantile(%v) = %v, want %v within %v", q, got, want, sketchAccuracy)
+		}
+
+		if mergedGot := merged.quantile(q); mergedGot != got {
+			t.Errorf("merged quantile(%v) = %v, want %v from a single sketch", q, mergedGot, got)
+		}
+	}
+}
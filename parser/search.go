@@ -2,8 +2,10 @@
 package parser
 
 import (
+	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/busbud/tidalwave/logger"
 	"github.com/busbud/tidalwave/sqlquery"
@@ -15,6 +17,7 @@ import (
 type LogQueryStruct struct {
 	LogPath     string
 	LineNumbers [][]int
+	Done        chan struct{} // Closed once the log file has been parsed.
 }
 
 func formatLine(query *sqlquery.QueryParams, line []byte) []byte {
@@ -23,8 +26,13 @@ func formatLine(query *sqlquery.QueryParams, line []byte) []byte {
 		selectedEntries := []string{}
 		for idx, res := range gjson.GetManyBytes(line, query.Selects...) {
 			keyName := ""
+			if expression := query.SelectExpressions[idx]; expression != nil {
+				keyName = expression.Name
+				res = expression.Eval(line)
+			}
+
 			for _, queryParam := range query.Queries {
-				if queryParam.KeyPath == query.Selects[idx] && queryParam.KeyName != "" {
+				if keyName == "" && queryParam.KeyPath == query.Selects[idx] && queryParam.KeyName != "" {
 					keyName = queryParam.KeyName
 					break
 				}
@@ -49,19 +57,79 @@ func formatLine(query *sqlquery.QueryParams, line []byte) []byte {
 	return line
 }
 
-func searchParse(query *sqlquery.QueryParams, logStruct *LogQueryStruct, coreLimit <-chan bool, submitChannel chan<- []byte, wg *sync.WaitGroup) {
+// searchLimit applies a query's OFFSET and LIMIT to lines submitted to the search results, and closes stop once the
+// limit has been reached so workers stop reading log files.
+type searchLimit struct {
+	sync.Mutex
+	offset    int
+	remaining int
+	stop      chan struct{}
+}
+
+func newSearchLimit(query *sqlquery.QueryParams) *searchLimit {
+	limit := &searchLimit{
+		offset:    query.Offset,
+		remaining: query.Limit,
+		stop:      make(chan struct{}),
+	}
+
+	if limit.remaining == 0 {
+		close(limit.stop)
+	}
+
+	return limit
+}
+
+// submit sends a line to the results channel if it's within OFFSET and LIMIT, returning false once no more lines are
+// needed.
+func (sl *searchLimit) submit(submitChannel chan<- []byte, line []byte) bool {
+	sl.Lock()
+	defer sl.Unlock()
+
+	if sl.remaining == 0 {
+		return false
+	}
+
+	if sl.offset > 0 {
+		sl.offset--
+		return true
+	}
+
+	submitChannel <- line
+	if sl.remaining > 0 {
+		sl.remaining--
+		if sl.remaining == 0 {
+			close(sl.stop)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (sl *searchLimit) stopped() bool {
+	select {
+	case <-sl.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func searchParse(query *sqlquery.QueryParams, logStruct *LogQueryStruct, limit *searchLimit, coreLimit <-chan bool, submitChannel chan<- []byte, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer close(logStruct.Done)
 
 	logger.Log.Debugf("Processing: %s", logStruct.LogPath)
 	lineNumber := -1
 	lastLineNumber := -1
 
-	err := readLines(logStruct.LogPath, func(line *[]byte) {
+	err := readLinesUntil(logStruct.LogPath, limit.stop, func(line *[]byte) {
 		lineNumber++
 
 		if query.ProcessLine(line) {
 			if viper.GetBool("skip-sort") {
-				submitChannel <- formatLine(query, *line)
+				limit.submit(submitChannel, formatLine(query, *line))
 				return
 			}
 
@@ -81,9 +149,10 @@ func searchParse(query *sqlquery.QueryParams, logStruct *LogQueryStruct, coreLim
 	<-coreLimit
 }
 
-func searchSubmit(query *sqlquery.QueryParams, logStruct *LogQueryStruct, submitChannel chan<- []byte) {
+// readMatchedLines reads the lines of a log file that matched the query during searchParse.
+func readMatchedLines(logStruct *LogQueryStruct, stop <-chan struct{}, callback func(*[]byte)) {
 	lineNumber := -1
-	err := readLines(logStruct.LogPath, func(line *[]byte) {
+	err := readLinesUntil(logStruct.LogPath, stop, func(line *[]byte) {
 		lineNumber++
 		acceptLine := false
 		// TODO: Can this be better? Faster?
@@ -95,7 +164,7 @@ func searchSubmit(query *sqlquery.QueryParams, logStruct *LogQueryStruct, submit
 		}
 
 		if acceptLine {
-			submitChannel <- formatLine(query, *line)
+			callback(line)
 		}
 	})
 
@@ -104,33 +173,142 @@ func searchSubmit(query *sqlquery.QueryParams, logStruct *LogQueryStruct, submit
 	}
 }
 
-// Search executes a normal match query over log results.
-// SELECT * FROM testapp WHERE date > '2016-10-05'
+func searchSubmit(query *sqlquery.QueryParams, logStruct *LogQueryStruct, limit *searchLimit, submitChannel chan<- []byte) {
+	readMatchedLines(logStruct, limit.stop, func(line *[]byte) {
+		limit.submit(submitChannel, formatLine(query, *line))
+	})
+}
+
+// timedLine is a matched line along with its timestamp, used to merge log files of different applications.
+type timedLine struct {
+	time time.Time
+	line []byte
+}
+
+// mergeSubmit submits the matched lines of log files covering the same hour for different applications, interleaved
+// by each line's timestamp. Every file is expected to already be in chronological order, so only the next line of
+// each file needs to be compared. Lines without a timestamp keep the timestamp of the line before them.
+func mergeSubmit(query *sqlquery.QueryParams, logStructs []*LogQueryStruct, limit *searchLimit, submitChannel chan<- []byte) {
+	streams := make([]chan timedLine, len(logStructs))
+	for idx := range logStructs {
+		streams[idx] = make(chan timedLine, 1000)
+		go func(logStruct *LogQueryStruct, stream chan<- timedLine) {
+			defer close(stream)
+
+			lastTime := time.Time{}
+			readMatchedLines(logStruct, limit.stop, func(line *[]byte) {
+				if t, ok := sqlquery.ParseTimestamp(gjson.GetBytes(*line, query.TimestampKey), query.TimestampLayouts...); ok {
+					lastTime = t
+				}
+
+				select {
+				case stream <- timedLine{lastTime, formatLine(query, *line)}:
+				case <-limit.stop:
+				}
+			})
+		}(logStructs[idx], streams[idx])
+	}
+
+	heads := make([]*timedLine, len(streams))
+	for idx := range streams {
+		if next, ok := <-streams[idx]; ok {
+			heads[idx] = &next
+		}
+	}
+
+	for {
+		// Ties go to the first file, which follows the order of the FROM clause.
+		nextIdx := -1
+		for idx := range heads {
+			if heads[idx] != nil && (nextIdx == -1 || heads[idx].time.Before(heads[nextIdx].time)) {
+				nextIdx = idx
+			}
+		}
+
+		if nextIdx == -1 || !limit.submit(submitChannel, heads[nextIdx].line) {
+			break
+		}
+
+		heads[nextIdx] = nil
+		if next, ok := <-streams[nextIdx]; ok {
+			heads[nextIdx] = &next
+		}
+	}
+
+	// Drain any remaining lines so readers stop once the limit has been reached.
+	for idx := range streams {
+		for range streams[idx] {
+		}
+	}
+}
+
+// Search executes a normal match query over log results. Sorted results are submitted file by file as soon as all
+// previous files have been parsed, and no further files are read once the query's LIMIT has been reached. When
+// querying multiple applications, lines are interleaved in chronological order.
+// SELECT * FROM testapp WHERE date > '2016-10-05' LIMIT 10
 func (tp *TidalwaveParser) Search() chan []byte {
+	if len(tp.Query.OrderBy) > 0 {
+		return tp.orderedSearch()
+	}
+
 	var wg sync.WaitGroup
 	logsLen := len(tp.LogPaths)
-	wg.Add(logsLen)
+	limit := newSearchLimit(tp.Query)
 
 	submitChannel := make(chan []byte, 10000)
+	logs := make([]LogQueryStruct, logsLen)
+	for idx, logPath := range tp.LogPaths {
+		logs[idx] = LogQueryStruct{LogPath: logPath, Done: make(chan struct{})}
+	}
+
 	go func() {
 		coreLimit := make(chan bool, tp.MaxParallelism)
-		logs := make([]LogQueryStruct, logsLen)
-		for idx, logPath := range tp.LogPaths {
-			logs[idx] = LogQueryStruct{LogPath: logPath}
-			go searchParse(tp.Query, &logs[idx], coreLimit, submitChannel, &wg)
+		for idx := range logs {
+			if limit.stopped() {
+				close(logs[idx].Done)
+				continue
+			}
+
+			wg.Add(1)
+			go searchParse(tp.Query, &logs[idx], limit, coreLimit, submitChannel, &wg)
 			coreLimit <- true
 		}
+	}()
 
-		wg.Wait()
-
+	go func() {
 		if !viper.GetBool("skip-sort") {
-			for idx := range logs {
-				if len(logs[idx].LineNumbers) > 0 {
-					searchSubmit(tp.Query, &logs[idx], submitChannel)
+			// Files of the same hour for different applications are next to each other in LogPaths, and are merged
+			// together by timestamp.
+			for start := 0; start < len(logs); {
+				end := start + 1
+				for len(tp.Query.From) > 1 && end < len(logs) && path.Base(logs[end].LogPath) == path.Base(logs[start].LogPath) {
+					end++
+				}
+
+				group := []*LogQueryStruct{}
+				for idx := start; idx < end; idx++ {
+					<-logs[idx].Done
+					if len(logs[idx].LineNumbers) > 0 {
+						group = append(group, &logs[idx])
+					}
+				}
+				start = end
+
+				switch {
+				case len(group) == 0 || limit.stopped():
+				case len(group) == 1:
+					searchSubmit(tp.Query, group[0], limit, submitChannel)
+				default:
+					mergeSubmit(tp.Query, group, limit, submitChannel)
 				}
 			}
+		} else {
+			for idx := range logs {
+				<-logs[idx].Done
+			}
 		}
 
+		wg.Wait()
 		close(submitChannel)
 	}()
 
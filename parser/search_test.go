@@ -0,0 +1,203 @@
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/tidwall/gjson"
+)
+
+func TestSearchLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPaths := writeTestLogs(t, dir, 4, 10)
+
+	tests := []struct {
+		limit  int
+		offset int
+		want   int
+	}{
+		{-1, 0, 40},
+		{0, 0, 0},
+		{1, 0, 1},
+		{5, 12, 5},
+		{5, 38, 2},
+		{-1, 35, 5},
+		{10, 40, 0},
+	}
+
+	for _, test := range tests {
+		tp := TidalwaveParser{MaxParallelism: 2, LogPaths: logPaths, Query: &sqlquery.QueryParams{Limit: test.limit, Offset: test.offset}}
+
+		rows := []string{}
+		for line := range tp.Search() {
+			rows = append(rows, strings.TrimSpace(string(line)))
+		}
+
+		if len(rows) != test.want {
+			t.Fatalf("LIMIT %d OFFSET %d returned %d rows, want %d", test.limit, test.offset, len(rows), test.want)
+		}
+
+		// Lines are returned file by file in the order they were logged.
+		for idx, row := range rows {
+			position := test.offset + idx
+			if want := fmt.Sprintf(`{"file":%d,"line":%d}`, position/10, position%10); row != want {
+				t.Fatalf("LIMIT %d OFFSET %d row %d = %s, want %s", test.limit, test.offset, idx, row, want)
+			}
+		}
+	}
+}
+
+// Files of the same hour for different applications are interleaved by timestamp, one hour after the other.
+func TestSearchMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, app := range []string{"api", "web"} {
+		if err := os.Mkdir(filepath.Join(dir, app), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logPaths := []string{
+		writeLines(t, dir, "api/2024-01-05T10-00-00.log",
+			`{"id":"a1","time":"2024-01-05T10:00:01Z"}`,
+			`{"id":"a2"}`,
+			`{"id":"a3","time":"2024-01-05T10:00:05Z"}`,
+			`{"id":"a4","time":"2024-01-05T10:00:09Z"}`),
+		writeLines(t, dir, "web/2024-01-05T10-00-00.log",
+			`{"id":"w1","time":1704448801}`,
+			`{"id":"w2","time":"2024-01-05T10:00:03Z"}`,
+			`{"id":"w3","time":"2024-01-05T10:00:07Z"}`),
+		writeLines(t, dir, "api/2024-01-05T11-00-00.log",
+			`{"id":"a5","time":"2024-01-05T11:00:00Z"}`),
+		writeLines(t, dir, "web/2024-01-05T11-00-00.log",
+			`{"id":"w4","time":"2024-01-05T10:59:59Z"}`),
+	}
+
+	tests := []struct {
+		limit  int
+		offset int
+		want   string
+	}{
+		// a2 keeps the timestamp of a1, the same as w1 which is logged in seconds since the epoch. Ties go to the first
+		// application of FROM.
+		{-1, 0, "a1 a2 w1 w2 a3 w3 a4 w4 a5"},
+		{3, 2, "w1 w2 a3"},
+		{2, 6, "a4 w4"},
+	}
+
+	for _, test := range tests {
+		tp := TidalwaveParser{MaxParallelism: 2, LogPaths: logPaths, Query: &sqlquery.QueryParams{
+			From:         []string{"api", "web"},
+			Limit:        test.limit,
+			Offset:       test.offset,
+			TimestampKey: "time",
+		}}
+
+		ids := []string{}
+		for line := range tp.Search() {
+			ids = append(ids, gjson.GetBytes(line, "id").String())
+		}
+
+		if got := strings.Join(ids, " "); got != test.want {
+			t.Errorf("LIMIT %d OFFSET %d = %s, want %s", test.limit, test.offset, got, test.want)
+		}
+	}
+}
+
+// Workers stop reading log files once stop is closed, which happens as soon as LIMIT lines have been submitted.
+func TestSearchLimitStop(t *testing.T) {
+	limit := newSearchLimit(&sqlquery.QueryParams{Limit: 2, Offset: 1})
+	submitChannel := make(chan []byte, 10)
+
+	for idx, want := range []bool{true, true, false, false} {
+		if got := limit.submit(submitChannel, []byte{byte('a' + idx)}); got != want {
+			t.Errorf("submit %d = %v, want %v", idx, got, want)
+		}
+	}
+	close(submitChannel)
+
+	submitted := ""
+	for line := range submitChannel {
+		submitted += string(line)
+	}
+	if submitted != "bc" || !limit.stopped() {
+		t.Errorf("submitted %q, stopped %v", submitted, limit.stopped())
+	}
+
+	if !newSearchLimit(&sqlquery.QueryParams{Limit: 0}).stopped() || newSearchLimit(&sqlquery.QueryParams{Limit: -1}).stopped() {
+		t.Error("only LIMIT 0 should stop before any line is read")
+	}
+
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	read := 0
+	stop := make(chan struct{})
+	err = readLinesUntil(writeTestLogs(t, dir, 1, 10)[0], stop, func(line *[]byte) {
+		read++
+		if read == 3 {
+			close(stop)
+		}
+	})
+	if err != nil || read != 3 {
+		t.Errorf("read %d lines after stop was closed on the third, %v", read, err)
+	}
+}
+
+func TestLimitKeys(t *testing.T) {
+	keys := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		limit  int
+		offset int
+		want   []string
+	}{
+		{-1, 0, keys},
+		{2, 0, []string{"a", "b"}},
+		{2, 1, []string{"b", "c"}},
+		{10, 3, []string{"d"}},
+		{-1, 4, []string{}},
+		{0, 0, []string{}},
+	}
+
+	for _, test := range tests {
+		got := limitKeys(&sqlquery.QueryParams{Limit: test.limit, Offset: test.offset}, keys)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("LIMIT %d OFFSET %d = %v, want %v", test.limit, test.offset, got, test.want)
+		}
+	}
+}
+
+func TestDistinctLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tp := TidalwaveParser{MaxParallelism: 2, LogPaths: writeTestLogs(t, dir, 3, 5), Query: &sqlquery.QueryParams{AggrPath: "line", Limit: 2, Offset: 1}}
+	if got := *tp.Distinct(); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Errorf("DISTINCT LIMIT 2 OFFSET 1 = %v", got)
+	}
+
+	if got := *tp.CountDistinct(); !reflect.DeepEqual(got, map[string]int{"1": 3, "2": 3}) {
+		t.Errorf("COUNT(DISTINCT) LIMIT 2 OFFSET 1 = %v", got)
+	}
+}
@@ -0,0 +1,118 @@
+// Package parser handles parsing log files based on the SQL execution type.
+package parser
+
+import (
+	"sync"
+
+	"github.com/busbud/tidalwave/logger"
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/tidwall/gjson"
+)
+
+// DefaultMaxSubqueryMemory is the default amount of megabytes of values each subquery can hold in memory.
+const DefaultMaxSubqueryMemory = 256
+
+// Rough amount of bytes used by each value in a subquery's hash set, on top of the value itself.
+const valueSetOverhead = 48
+
+// valueSet is the hash set of values selected by a subquery, shared by the workers parsing its log files.
+type valueSet struct {
+	sync.Mutex
+	values   map[string]struct{}
+	size     int
+	maxSize  int
+	exceeded bool
+	stop     chan struct{}
+}
+
+// add adds a value to the set, closing stop once the set has grown past its maximum size.
+func (set *valueSet) add(value gjson.Result) {
+	key := sqlquery.ValueKey(value)
+
+	set.Lock()
+	defer set.Unlock()
+
+	if _, ok := set.values[key]; ok || set.exceeded {
+		return
+	}
+
+	set.values[key] = struct{}{}
+	set.size += len(key) + valueSetOverhead
+	if set.size > set.maxSize {
+		set.exceeded = true
+		close(set.stop)
+	}
+}
+
+func valueSetParse(query *sqlquery.QueryParams, set *valueSet, logPath string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	err := readLinesUntil(logPath, set.stop, func(line *[]byte) {
+		if !query.ProcessLine(line) {
+			return
+		}
+
+		for _, res := range sqlquery.KeyValues(*line, query.AggrPath) {
+			if res.Type != gjson.Null {
+				set.add(res)
+			}
+		}
+	})
+
+	if err != nil {
+		logger.Log.Fatal(err)
+	}
+}
+
+// ValueSet executes a subquery, returning the distinct values of its selected key.
+// SELECT line.req_id FROM api WHERE line.level >= 50
+func (tp *TidalwaveParser) ValueSet(maxMemory int) map[string]struct{} {
+	set := &valueSet{
+		values:  map[string]struct{}{},
+		maxSize: maxMemory * 1024 * 1024,
+		stop:    make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(tp.LogPaths))
+
+	coreLimit := make(chan bool, tp.MaxParallelism)
+	for _, logPath := range tp.LogPaths {
+		coreLimit <- true
+		go func(logPath string) {
+			valueSetParse(tp.Query, set, logPath, &wg)
+			<-coreLimit
+		}(logPath)
+	}
+
+	wg.Wait()
+
+	if set.exceeded {
+		logger.Log.Panicf("Subquery selected more then the maximum of %d MB of values, set by --max-subquery-memory", maxMemory)
+	}
+
+	return set.values
+}
+
+// resolveSubqueries executes the IN (SELECT ...) subqueries of a query before the query itself, filling the hash set
+// each line is looked up in. Subqueries within subqueries are executed first, and subqueries that were already resolved
+// are skipped.
+func resolveSubqueries(query *sqlquery.QueryParams, logRoot string, maxParallelism, maxMemory int) {
+	for _, param := range query.Subqueries() {
+		if param.ValSet != nil {
+			continue
+		}
+
+		resolveSubqueries(param.Subquery, logRoot, maxParallelism, maxMemory)
+
+		logPaths := GetLogPaths(param.Subquery, logRoot)
+		logger.Log.Debugf("Subquery Log Paths: %s", logPaths)
+
+		subparser := TidalwaveParser{
+			MaxParallelism: maxParallelism,
+			LogPaths:       logPaths,
+			Query:          param.Subquery,
+		}
+		param.ValSet = subparser.ValueSet(maxMemory)
+	}
+}
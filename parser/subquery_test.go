@@ -0,0 +1,112 @@
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/tidwall/gjson"
+)
+
+func TestResolveSubqueries(t *testing.T) {
+	logRoot, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logRoot)
+
+	apps := map[string][]string{
+		"errors": {`{"req":"a","level":50}`, `{"req":1.0,"level":60}`, `{"req":"b","level":30}`, `{"req":null,"level":50}`, `{"level":50}`},
+		"admins": {`{"user":"u1"}`, `{"user":"u3"}`},
+		"api": {
+			`{"req":"a","user":"u1"}`, `{"req":"b","user":"u1"}`, `{"req":1,"user":"u2"}`, `{"req":"1","user":"u3"}`,
+			`{"req":null,"user":"u1"}`, `{"user":"u1"}`,
+		},
+	}
+	for app, lines := range apps {
+		folder := filepath.Join(logRoot, app, "2024-01-05")
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeLines(t, folder, "2024-01-05T10-00-00.log", lines...)
+	}
+
+	numberParam := func(keyPath, operator string, value float64) *sqlquery.QueryNode {
+		return &sqlquery.QueryNode{Param: &sqlquery.QueryParam{KeyPath: keyPath, Operator: operator, IsNumber: true, ValNumber: value}}
+	}
+	subqueryParam := func(keyPath, from, selected string, where *sqlquery.QueryNode) *sqlquery.QueryNode {
+		return &sqlquery.QueryNode{Param: &sqlquery.QueryParam{KeyPath: keyPath, Operator: sqlquery.OperatorIn, Subquery: &sqlquery.QueryParams{
+			Type:     sqlquery.TypeDistinct,
+			From:     []string{from},
+			AggrPath: selected,
+			Limit:    -1,
+			Where:    where,
+		}}}
+	}
+	count := func(where *sqlquery.QueryNode) int {
+		query := &sqlquery.QueryParams{Type: sqlquery.TypeCount, From: []string{"api"}, Limit: -1, Where: where}
+		resolveSubqueries(query, logRoot, 2, DefaultMaxSubqueryMemory)
+
+		tp := TidalwaveParser{MaxParallelism: 2, LogPaths: GetLogPaths(query, logRoot), Query: query}
+		return tp.Count()
+	}
+
+	// WHERE line.req IN (SELECT line.req FROM errors WHERE line.level >= 50), where 1, 1.0 and '1' are the same value
+	// as they are with IN lists, and NULL is never selected.
+	where := subqueryParam("req", "errors", "req", numberParam("level", ">=", 50))
+	if got := count(where); got != 3 {
+		t.Errorf("IN (SELECT ...) matched %d lines, want 3", got)
+	}
+
+	keys := []string{}
+	for key := range where.Param.ValSet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if want := []string{sqlquery.ValueKey(gjson.Parse(`1`)), sqlquery.ValueKey(gjson.Parse(`"a"`))}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("subquery selected %v, want %v", keys, want)
+	}
+
+	// Subqueries within subqueries are resolved first.
+	// WHERE line.req IN (SELECT line.req FROM api WHERE line.user IN (SELECT line.user FROM admins))
+	nested := subqueryParam("req", "api", "req", subqueryParam("user", "admins", "user", nil))
+	if got := count(nested); got != 4 {
+		t.Errorf("nested IN (SELECT ...) matched %d lines, want 4", got)
+	}
+
+	// Subqueries that were already resolved, such as by each branch of a UNION, aren't executed again.
+	resolved := subqueryParam("req", "errors", "req", nil)
+	resolved.Param.ValSet = map[string]struct{}{sqlquery.ValueKey(gjson.Parse(`"b"`)): {}}
+	if got := count(resolved); got != 1 {
+		t.Errorf("resolved IN (SELECT ...) matched %d lines, want 1", got)
+	}
+}
+
+func TestValueSetMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tp := TidalwaveParser{MaxParallelism: 2, LogPaths: writeTestLogs(t, dir, 2, 10), Query: &sqlquery.QueryParams{
+		Type:     sqlquery.TypeDistinct,
+		AggrPath: "line",
+		Limit:    -1,
+	}}
+	if got := len(tp.ValueSet(1)); got != 10 {
+		t.Errorf("subquery selected %d values, want 10", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("subquery selecting more then --max-subquery-memory didn't panic")
+		}
+	}()
+
+	tp.ValueSet(0)
+}
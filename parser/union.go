@@ -0,0 +1,269 @@
+// Package parser handles parsing log files based on the SQL execution type.
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/busbud/tidalwave/logger"
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/spf13/viper"
+)
+
+// DefaultMaxUnionMemory is the default amount of megabytes of rows a UNION can hold in memory to skip duplicate rows.
+const DefaultMaxUnionMemory = 256
+
+// jsonRow creates a row of key and value pairs, in the order they're given.
+func jsonRow(pairs ...interface{}) []byte {
+	var row bytes.Buffer
+	row.WriteByte('{')
+	for idx := 0; idx < len(pairs); idx += 2 {
+		if idx > 0 {
+			row.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(pairs[idx])
+		value, err := json.Marshal(pairs[idx+1])
+		if err != nil {
+			logger.Log.Fatal(err)
+		}
+
+		row.Write(key)
+		row.WriteByte(':')
+		row.Write(value)
+	}
+	row.WriteByte('}')
+
+	return row.Bytes()
+}
+
+// resultRows passes the results of a query to callback as JSON rows, the same as lines of a search. Single values
+// are a row named after the value, such as {"count":10}.
+func resultRows(query *sqlquery.QueryParams, results interface{}, callback func(row []byte) bool) {
+	keyName := query.AggrPath[strings.LastIndex(query.AggrPath, ".")+1:]
+
+	switch results := results.(type) {
+	case ChannelResults:
+		for line := range results.Channel {
+			if !callback(bytes.TrimRight(line, "\r\n")) {
+				// Drain the remaining lines so the search can finish.
+				for range results.Channel {
+				}
+				return
+			}
+		}
+	case TableResults:
+		for _, row := range *results.Results {
+			if !callback(row) {
+				return
+			}
+		}
+	case IntResults:
+		callback(jsonRow("count", results.Results))
+	case FloatResults:
+		callback(jsonRow(query.Columns[0].Name, results.Results))
+	case ArrayResults:
+		for _, value := range *results.Results {
+			if !callback(jsonRow(keyName, value)) {
+				return
+			}
+		}
+	case ObjectResults:
+		for _, value := range sortedKeys(*results.Results) {
+			if !callback(jsonRow(keyName, value, "count", (*results.Results)[value])) {
+				return
+			}
+		}
+	}
+}
+
+func sortedKeys(values map[string]int) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Union executes each query of a UNION one after the other, returning their rows. UNION ALL returns every row, where
+// UNION skips rows that were already returned.
+// SELECT * FROM api WHERE line.level >= 50 UNION ALL SELECT * FROM payments WHERE line.status = 'failed'
+func (tp *TidalwaveParser) Union() chan []byte {
+	// Rows are read from a goroutine where errors can't be returned to the caller, so every part of a branch that
+	// may fail runs beforehand. Subqueries are resolved, and joins hold the lines of their smaller apps once executed.
+	results := make([]interface{}, len(tp.Query.Unions))
+	for idx, branch := range tp.Query.Unions {
+		resolveSubqueries(branch, viper.GetString("logroot"), tp.MaxParallelism, viper.GetInt("max-subquery-memory"))
+		if len(branch.Joins) > 0 {
+			results[idx] = execute(branch)
+		}
+	}
+
+	// UNION holds every row it returned to skip duplicates, so its rows are read beforehand as well.
+	var distinctRows [][]byte
+	if !tp.Query.UnionAll {
+		distinctRows = tp.distinctRows(results)
+	}
+
+	limit := newSearchLimit(tp.Query)
+	submitChannel := make(chan []byte, 10000)
+
+	go func() {
+		defer close(submitChannel)
+
+		if !tp.Query.UnionAll {
+			for _, row := range distinctRows {
+				if !limit.submit(submitChannel, row) {
+					return
+				}
+			}
+			return
+		}
+
+		for idx, branch := range tp.Query.Unions {
+			if results[idx] == nil && !limit.stopped() {
+				results[idx] = execute(branch)
+			}
+
+			resultRows(branch, results[idx], func(row []byte) bool {
+				return limit.submit(submitChannel, row)
+			})
+		}
+	}()
+
+	return submitChannel
+}
+
+// distinctRows reads the rows of each query of a UNION skipping duplicates, up to the rows needed by OFFSET and LIMIT.
+// Rows are held in memory up to --max-union-memory.
+func (tp *TidalwaveParser) distinctRows(results []interface{}) [][]byte {
+	maxMemory := viper.GetInt("max-union-memory")
+	maxRows := -1
+	if tp.Query.Limit >= 0 {
+		maxRows = tp.Query.Offset + tp.Query.Limit
+	}
+
+	seen := map[string]struct{}{}
+	rows := [][]byte{}
+	size := 0
+	exceeded := false
+	for idx, branch := range tp.Query.Unions {
+		if exceeded || (maxRows >= 0 && len(rows) >= maxRows) {
+			// Results that were already executed are read to the end so their searches can finish.
+			if results[idx] != nil {
+				resultRows(branch, results[idx], func(row []byte) bool { return false })
+			}
+			continue
+		}
+
+		if results[idx] == nil {
+			results[idx] = execute(branch)
+		}
+
+		resultRows(branch, results[idx], func(row []byte) bool {
+			if _, ok := seen[string(row)]; ok {
+				return true
+			}
+
+			// Each row is held both in the set of seen rows and in the results.
+			seen[string(row)] = struct{}{}
+			rows = append(rows, row)
+			size += 2*len(row) + valueSetOverhead
+			if size > maxMemory*1024*1024 {
+				exceeded = true
+				return false
+			}
+
+			return maxRows < 0 || len(rows) < maxRows
+		})
+	}
+
+	if exceeded {
+		logger.Log.Panicf("UNION held more then the maximum of %d MB of rows, set by --max-union-memory", maxMemory)
+	}
+
+	return rows
+}
+
+// materializeWithQueries executes the WITH queries of a query in order, writing the rows of each to a temporary log
+// file. The paths of the files are returned so they can be removed once the query is done.
+func materializeWithQueries(query *sqlquery.QueryParams) []string {
+	logPaths := []string{}
+	defer removeOnPanic(&logPaths)
+
+	for _, with := range query.With {
+		file, err := ioutil.TempFile("", "tidalwave-with-")
+		if err != nil {
+			logger.Log.Fatal(err)
+		}
+
+		logPaths = append(logPaths, file.Name())
+		writer := bufio.NewWriter(file)
+		resultRows(with.Query, execute(with.Query), func(row []byte) bool {
+			if _, err = writer.Write(row); err == nil {
+				err = writer.WriteByte('\n')
+			}
+			if err != nil {
+				logger.Log.Fatal(err)
+			}
+			return true
+		})
+
+		if err = writer.Flush(); err != nil {
+			logger.Log.Fatal(err)
+		}
+		file.Close() //nolint:errcheck,gosec // Don't care if there's errors.
+
+		with.LogPath = file.Name()
+	}
+
+	return logPaths
+}
+
+// removeFiles removes temporary log files.
+func removeFiles(logPaths []string) {
+	for _, logPath := range logPaths {
+		os.Remove(logPath) //nolint:errcheck,gosec // Don't care if there's errors.
+	}
+}
+
+// removeOnPanic removes temporary log files when a query fails before its results are returned, then raises the
+// error again. It must be deferred.
+func removeOnPanic(logPaths *[]string) {
+	if err := recover(); err != nil {
+		removeFiles(*logPaths)
+		panic(err)
+	}
+}
+
+// removeAfterResults removes temporary log files once a query's results have been read.
+func removeAfterResults(results interface{}, logPaths []string) interface{} {
+	if len(logPaths) == 0 {
+		return results
+	}
+
+	channelResults, ok := results.(ChannelResults)
+	if !ok {
+		removeFiles(logPaths)
+		return results
+	}
+
+	submitChannel := make(chan []byte, 10000)
+	go func() {
+		defer removeFiles(logPaths)
+		defer close(submitChannel)
+
+		for line := range channelResults.Channel {
+			submitChannel <- line
+		}
+	}()
+
+	return ChannelResults{channelResults.Type, submitChannel}
+}
@@ -0,0 +1,217 @@
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/busbud/tidalwave/sqlquery"
+	"github.com/spf13/viper"
+)
+
+// writeAppLogs writes an hour of logs for app under logRoot, holding {"line":l} for each line.
+func writeAppLogs(t *testing.T, logRoot, app string, lines int) {
+	folder := filepath.Join(logRoot, app, "2024-01-05")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var body strings.Builder
+	for l := 0; l < lines; l++ {
+		fmt.Fprintf(&body, `{"line":%d}`+"\n", l)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(folder, "2024-01-05T10-00-00.log"), []byte(body.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	logRoot, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logRoot)
+
+	writeAppLogs(t, logRoot, "api", 10)
+	viper.Set("logroot", logRoot)
+	viper.Set("max-parallelism", 2)
+	viper.Set("max-union-memory", DefaultMaxUnionMemory)
+
+	tests := []struct {
+		all   bool
+		limit int
+		want  []string
+	}{
+		{true, -1, []string{`{"count":10}`, `{"count":10}`}},
+		{false, -1, []string{`{"count":10}`}},
+		{true, 1, []string{`{"count":10}`}},
+	}
+
+	for _, test := range tests {
+		countQuery := func() *sqlquery.QueryParams {
+			return &sqlquery.QueryParams{Type: sqlquery.TypeCount, From: []string{"api"}, Limit: -1}
+		}
+
+		tp := TidalwaveParser{MaxParallelism: 2, Query: &sqlquery.QueryParams{
+			Type:     sqlquery.TypeUnion,
+			Limit:    test.limit,
+			UnionAll: test.all,
+			Unions:   []*sqlquery.QueryParams{countQuery(), countQuery()},
+		}}
+
+		rows := []string{}
+		for row := range tp.Union() {
+			rows = append(rows, string(row))
+		}
+
+		if strings.Join(rows, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("UNION ALL %v LIMIT %d returned %v, want %v", test.all, test.limit, rows, test.want)
+		}
+	}
+}
+
+// Errors within a branch are raised by Union itself rather then from the goroutine reading rows, where they would
+// crash the process.
+func TestUnionSubqueryMemory(t *testing.T) {
+	logRoot, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logRoot)
+
+	writeAppLogs(t, logRoot, "api", 10)
+	viper.Set("logroot", logRoot)
+	defer viper.Set("max-subquery-memory", DefaultMaxSubqueryMemory)
+	viper.Set("max-subquery-memory", 0)
+
+	subquery := &sqlquery.QueryParams{Type: sqlquery.TypeDistinct, From: []string{"api"}, AggrPath: "line", Limit: -1}
+	branch := &sqlquery.QueryParams{Type: sqlquery.TypeCount, From: []string{"api"}, Limit: -1, Where: &sqlquery.QueryNode{
+		Param: &sqlquery.QueryParam{KeyPath: "line", Operator: sqlquery.OperatorIn, Subquery: subquery},
+	}}
+
+	tp := TidalwaveParser{MaxParallelism: 2, Query: &sqlquery.QueryParams{
+		Type:     sqlquery.TypeUnion,
+		Limit:    -1,
+		UnionAll: true,
+		Unions:   []*sqlquery.QueryParams{{Type: sqlquery.TypeCount, From: []string{"api"}, Limit: -1}, branch},
+	}}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Union didn't raise the subquery memory error")
+		}
+	}()
+
+	for range tp.Union() {
+	}
+}
+
+// UNION holds the rows it returned to skip duplicates, up to --max-union-memory.
+func TestUnionMemory(t *testing.T) {
+	logRoot, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logRoot)
+
+	writeAppLogs(t, logRoot, "api", 10)
+	viper.Set("logroot", logRoot)
+	defer viper.Set("max-union-memory", DefaultMaxUnionMemory)
+	viper.Set("max-union-memory", 0)
+
+	searchQuery := func() *sqlquery.QueryParams {
+		return &sqlquery.QueryParams{Type: sqlquery.TypeSearch, From: []string{"api"}, Limit: -1}
+	}
+
+	tp := TidalwaveParser{MaxParallelism: 2, Query: &sqlquery.QueryParams{
+		Type:   sqlquery.TypeUnion,
+		Limit:  -1,
+		Unions: []*sqlquery.QueryParams{searchQuery(), searchQuery()},
+	}}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Union didn't raise the union memory error")
+		}
+	}()
+
+	for range tp.Union() {
+	}
+}
+
+// withFiles lists the temporary log files of WITH queries left in dir.
+func withFiles(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "tidalwave-with-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+// The temporary log files of WITH queries are removed when a query fails.
+func TestWithQueriesRemoved(t *testing.T) {
+	logRoot, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logRoot)
+
+	writeAppLogs(t, logRoot, "api", 10)
+	viper.Set("logroot", logRoot)
+	viper.Set("max-parallelism", 2)
+	defer viper.Set("max-subquery-memory", DefaultMaxSubqueryMemory)
+	viper.Set("max-subquery-memory", 0)
+
+	tmpDir, err := ioutil.TempDir("", "tidalwave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmpDir)
+
+	// A count of the lines of api matching a subquery, which holds more then the maximum subquery memory.
+	failing := func() *sqlquery.QueryParams {
+		subquery := &sqlquery.QueryParams{Type: sqlquery.TypeDistinct, From: []string{"api"}, AggrPath: "line", Limit: -1}
+		return &sqlquery.QueryParams{Type: sqlquery.TypeCount, From: []string{"api"}, Limit: -1, Where: &sqlquery.QueryNode{
+			Param: &sqlquery.QueryParam{KeyPath: "line", Operator: sqlquery.OperatorIn, Subquery: subquery},
+		}}
+	}
+	search := &sqlquery.QueryParams{Type: sqlquery.TypeSearch, From: []string{"api"}, Limit: -1}
+
+	tests := []struct {
+		name  string
+		query *sqlquery.QueryParams
+	}{
+		{"a WITH query", &sqlquery.QueryParams{
+			Type:  sqlquery.TypeSearch,
+			From:  []string{"first"},
+			Limit: -1,
+			With:  []*sqlquery.WithQuery{{Name: "first", Query: search}, {Name: "second", Query: failing()}},
+		}},
+		{"the main query", func() *sqlquery.QueryParams {
+			query := failing()
+			query.With = []*sqlquery.WithQuery{{Name: "first", Query: search}}
+			return query
+		}()},
+	}
+
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s didn't raise the subquery memory error", test.name)
+				}
+			}()
+			executeWithQueries(test.query)
+		}()
+
+		if paths := withFiles(t, tmpDir); len(paths) != 0 {
+			t.Errorf("%s failing left %v", test.name, paths)
+		}
+	}
+}
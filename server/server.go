@@ -108,6 +108,18 @@ func New(version string) {
 				return jsonError(ctx, err)
 			}
 			return ctx.JSONBlob(200, bytes)
+		case parser.FloatResults:
+			bytes, err := results.MarshalJSON()
+			if err != nil {
+				return jsonError(ctx, err)
+			}
+			return ctx.JSONBlob(200, bytes)
+		case parser.TableResults:
+			bytes, err := results.MarshalJSON()
+			if err != nil {
+				return jsonError(ctx, err)
+			}
+			return ctx.JSONBlob(200, bytes)
 		default:
 			return ctx.JSON(400, map[string]string{"error": "Query type not supported"})
 		}
@@ -156,6 +168,10 @@ func New(version string) {
 			return ctx.JSON(400, map[string]string{"error": "Object results not supportred on /query-by-line. Use /query instead."})
 		case parser.IntResults:
 			return ctx.JSON(400, map[string]string{"error": "Integer results not supportred on /query-by-line. Use /query instead."})
+		case parser.FloatResults:
+			return ctx.JSON(400, map[string]string{"error": "Float results not supportred on /query-by-line. Use /query instead."})
+		case parser.TableResults:
+			return ctx.JSON(400, map[string]string{"error": "Table results not supportred on /query-by-line. Use /query instead."})
 		default:
 			return ctx.JSON(400, map[string]string{"error": "Query type not supported"})
 		}
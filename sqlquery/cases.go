@@ -5,51 +5,40 @@ import (
 	"github.com/dustinblackman/moment"
 )
 
-func stripQuotes(s string) string {
-	if len(s) > 0 && (s[0] == '"' || s[0] == '\'') {
-		s = s[1:]
-	}
-	if len(s) > 0 && (s[len(s)-1] == '"' || s[len(s)-1] == '\'') {
-		s = s[:len(s)-1]
-	}
-
-	return s
-}
-
-// ProcessInt handles processing an integer in a query
-func ProcessInt(q *QueryParam, res int) bool {
+// ProcessNumber handles processing a number in a query
+func ProcessNumber(q *QueryParam, res float64) bool {
 	switch q.Operator {
 	case "exists":
 		return true
 	case "in":
-		for _, val := range q.ValIntArray {
+		for _, val := range q.ValNumberArray {
 			if val == res {
 				return true
 			}
 		}
 		return false
 	case "=", "==":
-		if res == q.ValInt {
+		if res == q.ValNumber {
 			return true
 		}
 	case "!=":
-		if res != q.ValInt {
+		if res != q.ValNumber {
 			return true
 		}
 	case ">":
-		if res > q.ValInt {
+		if res > q.ValNumber {
 			return true
 		}
 	case ">=":
-		if res >= q.ValInt {
+		if res >= q.ValNumber {
 			return true
 		}
 	case "<":
-		if res < q.ValInt {
+		if res < q.ValNumber {
 			return true
 		}
 	case "<=":
-		if res <= q.ValInt {
+		if res <= q.ValNumber {
 			return true
 		}
 	}
@@ -57,9 +46,23 @@ func ProcessInt(q *QueryParam, res int) bool {
 	return false
 }
 
+// ProcessBool handles processing a boolean in a query
+func ProcessBool(q *QueryParam, res bool) bool {
+	switch q.Operator {
+	case "exists":
+		return true
+	case "=", "==":
+		return res == q.ValBool
+	case "!=":
+		return res != q.ValBool
+	}
+
+	return false
+}
+
 // ProcessString handles processing a string for a query
 func ProcessString(q *QueryParam, res string) bool {
-	switch q.Operator { // TODO: Support "like", both for value and entire log string
+	switch q.Operator {
 	case "exists":
 		if len(res) > 0 {
 			return true
@@ -71,8 +74,12 @@ func ProcessString(q *QueryParam, res string) bool {
 			}
 		}
 		return false
-	case "like", "ilike", "~~", "~~*":
+	case "~~", "~~*", "~", "~*":
 		return q.Regex.MatchString(res)
+	case "!~~", "!~~*", "!~", "!~*":
+		return !q.Regex.MatchString(res)
+	case OperatorTextSearch:
+		return q.TextQuery.Match([]byte(res))
 	case "=", "==":
 		if res == q.ValString {
 			return true
@@ -81,6 +88,14 @@ func ProcessString(q *QueryParam, res string) bool {
 		if res != q.ValString {
 			return true
 		}
+	case ">":
+		return res > q.ValString
+	case ">=":
+		return res >= q.ValString
+	case "<":
+		return res < q.ValString
+	case "<=":
+		return res <= q.ValString
 	}
 	return false
 }
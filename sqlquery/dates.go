@@ -2,15 +2,338 @@
 package sqlquery
 
 import (
+	"errors"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/busbud/tidalwave/logger"
 	"github.com/dustinblackman/moment"
 	"github.com/jinzhu/copier"
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+	dry "github.com/ungerik/go-dry"
 )
 
 const queryDateFormat = "YYYY-MM-DDTHH:mm:ss"
 
+// Same as queryDateFormat, for use with the time package.
+const queryDateLayout = "2006-01-02T15:04:05"
+
+// DefaultTimezone is the time zone of dates written without an offset, which matches the UTC names of log files.
+const DefaultTimezone = "UTC"
+
+// DefaultTimestampKey is the default JSON path to each log line's timestamp.
+const DefaultTimestampKey = "line.time"
+
+// Layouts tried in order when parsing timestamps that are strings.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05",
+}
+
+// Units accepted in intervals such as '15 minutes', and their duration.
+var intervalUnits = map[string]time.Duration{
+	"second":  time.Second,
+	"seconds": time.Second,
+	"sec":     time.Second,
+	"secs":    time.Second,
+	"minute":  time.Minute,
+	"minutes": time.Minute,
+	"min":     time.Minute,
+	"mins":    time.Minute,
+	"hour":    time.Hour,
+	"hours":   time.Hour,
+	"day":     24 * time.Hour,
+	"days":    24 * time.Hour,
+	"week":    7 * 24 * time.Hour,
+	"weeks":   7 * 24 * time.Hour,
+}
+
+// LoadLocation returns the time zone for a name such as America/Montreal, or an offset in hours such as -5.
+func LoadLocation(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+
+	if hours, err := strconv.ParseFloat(name, 64); err == nil {
+		return time.FixedZone(name, int(hours*3600))
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		logger.Log.Panicf("Time zone %s is not supported", name)
+	}
+
+	return location
+}
+
+func (qp *QueryParams) location() *time.Location {
+	if qp.Location == nil {
+		return time.UTC
+	}
+
+	return qp.Location
+}
+
+// handleSetStmt handles SET timezone = 'America/Montreal' and SET TIME ZONE 'America/Montreal' statements sent before
+// the query.
+func (qp *QueryParams) handleSetStmt(statement pgNodes.VariableSetStmt) {
+	if statement.Name == nil || *statement.Name != "timezone" {
+		logger.Log.Panicf("SET only supports timezone")
+	}
+
+	qp.Location = time.UTC
+	if len(statement.Args.Items) > 0 {
+		if val, ok := statement.Args.Items[0].(pgNodes.A_Const); ok {
+			qp.Location = LoadLocation(qp.repairString(convertAConst(val)))
+		}
+	}
+}
+
+// TimestampKey returns the configured JSON path to each log line's timestamp.
+func TimestampKey() string {
+	if key := viper.GetString("timestamp-key"); key != "" {
+		return key
+	}
+
+	return DefaultTimestampKey
+}
+
+// TimestampLayouts returns the configured Go time layouts of line timestamps, tried before the default layouts.
+func TimestampLayouts() []string {
+	return viper.GetStringSlice("timestamp-format")
+}
+
+// ParseTimestamp converts a log line's timestamp in to a time. Strings are parsed with layouts first, followed by ISO
+// 8601, and numbers as unix epochs in either seconds or milliseconds.
+func ParseTimestamp(value gjson.Result, layouts ...string) (time.Time, bool) {
+	switch value.Type {
+	case gjson.Number:
+		// Nanoseconds since the epoch are too large to be exact as a float, so seconds and their fraction are split.
+		if value.Num > 1e12 {
+			milliseconds := int64(value.Num)
+			return time.Unix(milliseconds/1000, milliseconds%1000*int64(time.Millisecond)).UTC(), true
+		}
+		seconds, fraction := math.Modf(value.Num)
+		return time.Unix(int64(seconds), int64(math.Round(fraction*1e6))*int64(time.Microsecond)).UTC(), true
+	case gjson.String:
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, value.Str); err == nil {
+				return t, true
+			}
+		}
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, value.Str); err == nil {
+				return t, true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// timeFilter compares the timestamp of each line against a date from the query, after log files have been selected
+// by their names.
+type timeFilter struct {
+	operator string
+	time     time.Time
+}
+
+func newTimeFilters(dates []DateParam) []timeFilter {
+	filters := []timeFilter{}
+	for idx := range dates {
+		d := &dates[idx]
+		t, err := time.Parse(queryDateLayout, d.Date)
+		if err != nil || d.Operator == "!=" {
+			continue
+		}
+
+		filter := timeFilter{operator: d.Operator, time: t}
+		if !d.TimeUsed {
+			switch d.Operator {
+			case ">":
+				// A date without a time is after the entire day, the same as when selecting folders.
+				filter.operator = ">="
+				filter.time = t.AddDate(0, 0, 1)
+			case "<=":
+				filter.operator = "<"
+				filter.time = t.Add(time.Second)
+			}
+		}
+
+		filters = append(filters, filter)
+	}
+
+	return filters
+}
+
+func (f *timeFilter) match(t time.Time) bool {
+	switch f.operator {
+	case "=", "==":
+		// Dates in queries are to the second, so = matches any time within it.
+		return !t.Before(f.time) && t.Before(f.time.Add(time.Second))
+	case ">":
+		return t.After(f.time)
+	case ">=":
+		return !t.Before(f.time)
+	case "<":
+		return t.Before(f.time)
+	case "<=":
+		return !t.After(f.time)
+	}
+
+	return true
+}
+
+// matchTimeFilters returns true if the line's timestamp is within the query's dates. Lines without a timestamp can't be
+// filtered and are kept, as the log file they're in already matched.
+func (qp *QueryParams) matchTimeFilters(line []byte) bool {
+	t, ok := ParseTimestamp(gjson.GetBytes(line, qp.TimestampKey), qp.TimestampLayouts...)
+	if !ok {
+		return true
+	}
+
+	for idx := range qp.timeFilters {
+		if !qp.timeFilters[idx].match(t) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseInterval converts a Postgres interval such as '15 minutes' or '1 hour 30 minutes' in to a duration.
+func parseInterval(interval string) (time.Duration, error) {
+	fields := strings.Fields(strings.ToLower(interval))
+	if len(fields) == 1 {
+		if unit, ok := intervalUnits[fields[0]]; ok {
+			return unit, nil
+		}
+		return time.ParseDuration(fields[0])
+	}
+
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return 0, errors.New("invalid interval " + interval)
+	}
+
+	var duration time.Duration
+	for idx := 0; idx < len(fields); idx += 2 {
+		amount, err := strconv.ParseFloat(fields[idx], 64)
+		unit, ok := intervalUnits[fields[idx+1]]
+		if err != nil || !ok {
+			return 0, errors.New("invalid interval " + interval)
+		}
+		duration += time.Duration(amount * float64(unit))
+	}
+
+	return duration, nil
+}
+
+// Functions returning the current time, such as now().
+var nowFunctions = []string{"now", "transaction_timestamp", "statement_timestamp", "clock_timestamp"}
+
+func (qp *QueryParams) convertInterval(node pgNodes.Node) (time.Duration, bool) {
+	typeCast, ok := node.(pgNodes.TypeCast)
+	if !ok || typeCast.TypeName == nil || len(typeCast.TypeName.Names.Items) == 0 {
+		return 0, false
+	}
+
+	typeName := typeCast.TypeName.Names.Items[len(typeCast.TypeName.Names.Items)-1].(pgNodes.String).Str
+	val, ok := typeCast.Arg.(pgNodes.A_Const)
+	if typeName != "interval" || !ok {
+		return 0, false
+	}
+
+	interval := qp.repairString(convertAConst(val))
+	duration, err := parseInterval(interval)
+	if err != nil {
+		logger.Log.Panicf("Interval %s is not supported", interval)
+	}
+
+	return duration, true
+}
+
+// evaluateTime returns the time of a relative time expression such as now() - interval '15 minutes', and whether the
+// time is a date without a time such as current_date.
+func (qp *QueryParams) evaluateTime(node pgNodes.Node) (t time.Time, dateOnly, ok bool) {
+	location := qp.location()
+	now := time.Now().In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+
+	switch node := node.(type) {
+	case pgNodes.FuncCall:
+		if dry.StringListContains(nowFunctions, getFuncName(node)) {
+			return now, false, true
+		}
+
+	case pgNodes.SQLValueFunction:
+		switch node.Op {
+		case pgNodes.SVFOP_CURRENT_DATE:
+			return today, true, true
+		case pgNodes.SVFOP_CURRENT_TIMESTAMP, pgNodes.SVFOP_CURRENT_TIMESTAMP_N, pgNodes.SVFOP_LOCALTIMESTAMP, pgNodes.SVFOP_LOCALTIMESTAMP_N:
+			return now, false, true
+		}
+
+	case pgNodes.TypeCast:
+		// now()::date
+		if node.TypeName != nil && len(node.TypeName.Names.Items) > 0 {
+			typeName := node.TypeName.Names.Items[len(node.TypeName.Names.Items)-1].(pgNodes.String).Str
+			if t, _, ok := qp.evaluateTime(node.Arg); ok && typeName == "date" {
+				return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()), true, true
+			}
+		}
+
+	case pgNodes.A_Expr:
+		operator := node.Name.Items[0].(pgNodes.String).Str
+		if node.Lexpr == nil || (operator != "+" && operator != "-") {
+			break
+		}
+
+		t, dateOnly, ok := qp.evaluateTime(node.Lexpr)
+		if !ok {
+			break
+		}
+
+		sign := time.Duration(1)
+		if operator == "-" {
+			sign = -1
+		}
+
+		// current_date - 1 subtracts days and remains a date.
+		if val, isConst := node.Rexpr.(pgNodes.A_Const); isConst && dateOnly {
+			if days, err := strconv.Atoi(convertAConst(val)); err == nil {
+				return t.AddDate(0, 0, int(sign)*days), true, true
+			}
+		}
+
+		if duration, isInterval := qp.convertInterval(node.Rexpr); isInterval {
+			return t.Add(sign * duration), false, true
+		}
+	}
+
+	return time.Time{}, false, false
+}
+
+// convertTimeExpression returns a relative time expression formatted the same as dates written in queries, in the
+// query's time zone.
+func (qp *QueryParams) convertTimeExpression(node pgNodes.Node) (string, bool) {
+	t, dateOnly, ok := qp.evaluateTime(node)
+	if !ok {
+		return "", false
+	}
+
+	if dateOnly {
+		return t.Format("2006-01-02"), true
+	}
+
+	return t.Format(queryDateLayout), true
+}
+
 // DateParam stores date query information.
 type DateParam struct {
 	Date     string
@@ -20,9 +343,38 @@ type DateParam struct {
 	Type     string
 }
 
-func createDateParam(date, operator string) []DateParam {
+// createDateParam parses a date compared against in a query. Dates with an offset such as
+// '2024-01-01T09:00:00-05:00', and dates outside of UTC, are converted to UTC to match the names of log files.
+func createDateParam(date, operator string, location *time.Location) []DateParam {
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		date = t.UTC().Format(queryDateLayout)
+	} else if location != nil && location != time.UTC {
+		// Days start and end at midnight in the query's time zone, which is in the middle of a day in UTC. Dates without
+		// a time compare the same as in UTC, so > is after the entire day and < is before the start of the day.
+		if len(date) > 0 && len(date) <= 10 {
+			switch operator {
+			case "=":
+				return append(createDateParam(date+"T00:00:00", ">=", location), createDateParam(date+"T23:59:59", "<=", location)...)
+			case ">":
+				if day, err := time.ParseInLocation("2006-01-02", date, location); err == nil {
+					operator = ">="
+					date = day.AddDate(0, 0, 1).Format(queryDateLayout)
+				} else {
+					date += "T00:00:00"
+				}
+			case "<=":
+				date += "T23:59:59"
+			default:
+				date += "T00:00:00"
+			}
+		}
+
+		if t, err := time.ParseInLocation(queryDateLayout, date, location); err == nil {
+			date = t.UTC().Format(queryDateLayout)
+		}
+	}
+
 	dateParam := DateParam{Operator: operator, TimeUsed: true}
-	date = stripQuotes(date)
 	if len(date) > 0 && len(date) <= 10 {
 		dateParam.TimeUsed = false
 		if operator == "<=" {
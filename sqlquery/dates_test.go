@@ -0,0 +1,245 @@
+package sqlquery
+
+import (
+	"testing"
+	"time"
+
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/tidwall/gjson"
+)
+
+func TestParseInterval(t *testing.T) {
+	tests := []struct {
+		interval string
+		want     time.Duration
+		err      bool
+	}{
+		{"15 minutes", 15 * time.Minute, false},
+		{"1 hour 30 minutes", 90 * time.Minute, false},
+		{"2 Days", 48 * time.Hour, false},
+		{"0.5 hours", 30 * time.Minute, false},
+		{"hour", time.Hour, false},
+		{"90s", 90 * time.Second, false},
+		{"1 week", 7 * 24 * time.Hour, false},
+		{"", 0, true},
+		{"15", 0, true},
+		{"15 fortnights", 0, true},
+		{"1 hour 30", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseInterval(test.interval)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("parseInterval(%q) = %v, %v, want %v, error %v", test.interval, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestCreateDateParam(t *testing.T) {
+	montreal := LoadLocation("America/Montreal")
+
+	type param struct {
+		operator string
+		date     string
+		timeUsed bool
+	}
+
+	tests := []struct {
+		date     string
+		operator string
+		location *time.Location
+		want     []param
+	}{
+		{"2024-01-05", "=", time.UTC, []param{{">=", "2024-01-05T00:00:00", false}, {"<=", "2024-01-05T23:59:59", false}}},
+		{"2024-01-05", ">", time.UTC, []param{{">", "2024-01-05T00:00:00", false}}},
+		{"2024-01-05", ">=", time.UTC, []param{{">=", "2024-01-05T00:00:00", false}}},
+		{"2024-01-05", "<", time.UTC, []param{{"<", "2024-01-05T00:00:00", false}}},
+		{"2024-01-05", "<=", time.UTC, []param{{"<=", "2024-01-05T23:59:59", false}}},
+		{"2024-01-05T09:30:00", ">", time.UTC, []param{{">", "2024-01-05T09:30:00", true}}},
+		{"2024-01-05T09:30:00-05:00", "<", nil, []param{{"<", "2024-01-05T14:30:00", true}}},
+
+		// Montreal is UTC-5 in January, and UTC-4 in July.
+		{"2024-01-05", "=", montreal, []param{{">=", "2024-01-05T05:00:00", true}, {"<=", "2024-01-06T04:59:59", true}}},
+		{"2024-01-05", ">", montreal, []param{{">=", "2024-01-06T05:00:00", true}}},
+		{"2024-01-05", ">=", montreal, []param{{">=", "2024-01-05T05:00:00", true}}},
+		{"2024-01-05", "<", montreal, []param{{"<", "2024-01-05T05:00:00", true}}},
+		{"2024-01-05", "<=", montreal, []param{{"<=", "2024-01-06T04:59:59", true}}},
+		{"2024-07-01", "=", montreal, []param{{">=", "2024-07-01T04:00:00", true}, {"<=", "2024-07-02T03:59:59", true}}},
+		{"2024-01-05T09:30:00", ">", montreal, []param{{">", "2024-01-05T14:30:00", true}}},
+	}
+
+	for _, test := range tests {
+		got := createDateParam(test.date, test.operator, test.location)
+		if len(got) != len(test.want) {
+			t.Errorf("createDateParam(%q, %q, %v) returned %d params, want %d", test.date, test.operator, test.location, len(got), len(test.want))
+			continue
+		}
+
+		for idx, want := range test.want {
+			if got[idx].Operator != want.operator || got[idx].Date != want.date || got[idx].TimeUsed != want.timeUsed {
+				t.Errorf("createDateParam(%q, %q, %v)[%d] = %s %s %v, want %s %s %v", test.date, test.operator, test.location, idx,
+					got[idx].Operator, got[idx].Date, got[idx].TimeUsed, want.operator, want.date, want.timeUsed)
+			}
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2024, 1, 5, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		value   string
+		layouts []string
+		want    time.Time
+		ok      bool
+	}{
+		{`"2024-01-05T10:30:15Z"`, nil, want, true},
+		{`"2024-01-05T05:30:15-05:00"`, nil, want, true},
+		{`"2024-01-05T10:30:15.250Z"`, nil, want.Add(250 * time.Millisecond), true},
+		{`"2024-01-05T10:30:15"`, nil, want, true},
+		{`"2024-01-05 10:30:15"`, nil, want, true},
+		{`1704450615`, nil, want, true},
+		{`1704450615.25`, nil, want.Add(250 * time.Millisecond), true},
+		{`1704450615250`, nil, want.Add(250 * time.Millisecond), true},
+		{`"05/01/2024 10:30:15"`, []string{"02/01/2006 15:04:05"}, want, true},
+		{`"05/01/2024 10:30:15"`, nil, time.Time{}, false},
+		{`"yesterday"`, nil, time.Time{}, false},
+		{`true`, nil, time.Time{}, false},
+		{`null`, nil, time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		got, ok := ParseTimestamp(gjson.Parse(test.value), test.layouts...)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("ParseTimestamp(%s) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+// Log files are selected by the hour, so lines within them are filtered by their own timestamp.
+func TestMatchTimeFilters(t *testing.T) {
+	dates := append(createDateParam("2024-01-05T10:00:00", ">", time.UTC), createDateParam("2024-01-05T12:00:00", "<=", time.UTC)...)
+	dates = append(dates, createDateParam("2024-01-05T11:00:00", "!=", time.UTC)...)
+	qp := &QueryParams{TimestampKey: "line.time", timeFilters: newTimeFilters(dates)}
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{`{"line":{"time":"2024-01-05T09:59:59Z"}}`, false},
+		{`{"line":{"time":"2024-01-05T10:00:00Z"}}`, false},
+		{`{"line":{"time":"2024-01-05T10:00:00.5Z"}}`, true},
+		{`{"line":{"time":"2024-01-05T11:00:00Z"}}`, true},
+		{`{"line":{"time":"2024-01-05T12:00:00Z"}}`, true},
+		{`{"line":{"time":"2024-01-05T12:00:01Z"}}`, false},
+		{`{"line":{"time":1704452400}}`, true},
+		{`{"line":{"time":1704463200000}}`, false},
+		{`{"line":{"time":"not a time"}}`, true},
+		{`{"line":{}}`, true},
+	}
+
+	for _, test := range tests {
+		line := []byte(test.line)
+		if got := qp.ProcessLine(&line); got != test.want {
+			t.Errorf("%s matched %v, want %v", test.line, got, test.want)
+		}
+	}
+
+	// date = '2024-01-05T10:00:00' matches the entire second.
+	qp = &QueryParams{TimestampKey: "time", timeFilters: newTimeFilters(createDateParam("2024-01-05T10:00:00", "=", time.UTC))}
+	for value, want := range map[string]bool{"09:59:59.999": false, "10:00:00": true, "10:00:00.999": true, "10:00:01": false} {
+		line := []byte(`{"time":"2024-01-05T` + value + `Z"}`)
+		if got := qp.ProcessLine(&line); got != want {
+			t.Errorf("date = '2024-01-05T10:00:00' matched %s: %v, want %v", value, got, want)
+		}
+	}
+}
+
+// Lines are matched the same in every time zone, relative to the start and end of the day in that time zone.
+func TestTimeFiltersAcrossTimeZones(t *testing.T) {
+	for _, location := range []*time.Location{time.UTC, LoadLocation("America/Montreal"), LoadLocation("9")} {
+		dayStart := time.Date(2024, 1, 5, 0, 0, 0, 0, location)
+		nextDay := dayStart.AddDate(0, 0, 1)
+
+		tests := []struct {
+			operator string
+			line     time.Time
+			want     bool
+		}{
+			{"=", dayStart.Add(-time.Second), false},
+			{"=", dayStart, true},
+			{"=", nextDay.Add(-time.Second), true},
+			{"=", nextDay, false},
+			{">", nextDay.Add(-time.Second), false},
+			{">", nextDay, true},
+			{">=", dayStart.Add(-time.Second), false},
+			{">=", dayStart, true},
+			{"<", dayStart.Add(-time.Second), true},
+			{"<", dayStart, false},
+			{"<=", nextDay.Add(-time.Second), true},
+			{"<=", nextDay, false},
+		}
+
+		for _, test := range tests {
+			qp := &QueryParams{TimestampKey: "time", timeFilters: newTimeFilters(createDateParam("2024-01-05", test.operator, location))}
+			line := []byte(`{"time":"` + test.line.Format(time.RFC3339) + `"}`)
+			if got := qp.ProcessLine(&line); got != test.want {
+				t.Errorf("date %s '2024-01-05' in %v matched %s: %v, want %v", test.operator, location, test.line.Format(time.RFC3339), got, test.want)
+			}
+		}
+	}
+}
+
+func TestEvaluateTime(t *testing.T) {
+	sql := "select * from app where date > now() - interval '15 minutes' and date < current_date + interval '1 hour 30 minutes'"
+	montreal := LoadLocation("America/Montreal")
+
+	interval := func(value string) pgNodes.Node { return testTypeCast(testConst(value), "interval") }
+	operator := func(name string, left, right pgNodes.Node) pgNodes.Node {
+		return pgNodes.A_Expr{Kind: pgNodes.AEXPR_OP, Name: pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: name}}}, Lexpr: left, Rexpr: right}
+	}
+	now := testFuncCall("now")
+	currentDate := pgNodes.SQLValueFunction{Op: pgNodes.SVFOP_CURRENT_DATE}
+
+	for _, location := range []*time.Location{time.UTC, montreal} {
+		qp := &QueryParams{SQLString: sql, SQLStringLower: sql, Location: location}
+		clock := time.Now().In(location)
+		today := time.Date(clock.Year(), clock.Month(), clock.Day(), 0, 0, 0, 0, location)
+
+		tests := []struct {
+			name     string
+			node     pgNodes.Node
+			want     time.Time
+			dateOnly bool
+		}{
+			{"now()", now, clock, false},
+			{"current_timestamp", pgNodes.SQLValueFunction{Op: pgNodes.SVFOP_CURRENT_TIMESTAMP}, clock, false},
+			{"now() - interval '15 minutes'", operator("-", now, interval("15 minutes")), clock.Add(-15 * time.Minute), false},
+			{"current_date", currentDate, today, true},
+			{"current_date - 1", operator("-", currentDate, testConst(1)), today.AddDate(0, 0, -1), true},
+			{"current_date + interval '1 hour 30 minutes'", operator("+", currentDate, interval("1 hour 30 minutes")), today.Add(90 * time.Minute), false},
+			{"now()::date", testTypeCast(now, "date"), today, true},
+		}
+
+		for _, test := range tests {
+			got, dateOnly, ok := qp.evaluateTime(test.node)
+			if !ok || dateOnly != test.dateOnly || got.Sub(test.want) > time.Second || test.want.Sub(got) > time.Second {
+				t.Errorf("%s in %s = %v, %v, %v, want %v, %v", test.name, location, got, dateOnly, ok, test.want, test.dateOnly)
+			}
+		}
+
+		// Relative times are compared the same as dates written in the query, in the query's time zone.
+		if got, ok := qp.convertTimeExpression(currentDate); !ok || got != today.Format("2006-01-02") {
+			t.Errorf("current_date in %s = %s", location, got)
+		}
+		if got, ok := qp.convertTimeExpression(operator("-", now, interval("15 minutes"))); !ok || len(got) != len(queryDateLayout) {
+			t.Errorf("now() - interval '15 minutes' in %s = %s", location, got)
+		}
+	}
+
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+	for _, node := range []pgNodes.Node{testConst("15 minutes"), testFuncCall("lower", now), operator("*", now, testConst(2))} {
+		if _, _, ok := qp.evaluateTime(node); ok {
+			t.Errorf("%+v was evaluated as a time", node)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/busbud/tidalwave/logger"
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/tidwall/gjson"
+	dry "github.com/ungerik/go-dry"
+)
+
+// Types supported by CAST(x AS type) and x::type, mapped from Postgres' internal type names.
+var castTypes = map[string]string{
+	"int2":    "int",
+	"int4":    "int",
+	"int8":    "int",
+	"int":     "int",
+	"integer": "int",
+	"bigint":  "int",
+	"float4":  "float",
+	"float8":  "float",
+	"numeric": "float",
+	"text":    "text",
+	"varchar": "text",
+	"bpchar":  "text",
+	"bool":    "bool",
+}
+
+// Operators usable in expressions such as line.end - line.start.
+var arithmeticOperators = []string{"+", "-", "*", "/", "%"}
+
+// scalarFunction is a function that computes a single value for each log line.
+type scalarFunction struct {
+	minArgs  int
+	maxArgs  int  // -1 for any amount of arguments
+	nullSafe bool // Called with NULL arguments, rather then returning NULL when any argument is NULL
+	call     func(args []gjson.Result) gjson.Result
+}
+
+// Registry of scalar functions usable in SELECT and WHERE.
+var scalarFunctions = map[string]scalarFunction{
+	"lower": {1, 1, false, func(args []gjson.Result) gjson.Result {
+		return stringValue(strings.ToLower(args[0].String()))
+	}},
+	"upper": {1, 1, false, func(args []gjson.Result) gjson.Result {
+		return stringValue(strings.ToUpper(args[0].String()))
+	}},
+	"length": {1, 1, false, func(args []gjson.Result) gjson.Result {
+		return numberValue(float64(utf8.RuneCountInString(args[0].String())))
+	}},
+	"substring": {2, 3, false, substring},
+	"split_part": {3, 3, false, func(args []gjson.Result) gjson.Result {
+		field, ok := toNumber(args[2])
+		if !ok || field < 1 {
+			return gjson.Result{}
+		}
+
+		parts := strings.Split(args[0].String(), args[1].String())
+		if int(field) > len(parts) {
+			return stringValue("")
+		}
+
+		return stringValue(parts[int(field)-1])
+	}},
+	"+": {2, 2, false, arithmetic(func(a, b float64) float64 { return a + b })},
+	"-": {2, 2, false, arithmetic(func(a, b float64) float64 { return a - b })},
+	"*": {2, 2, false, arithmetic(func(a, b float64) float64 { return a * b })},
+	"/": {2, 2, false, arithmetic(func(a, b float64) float64 { return a / b })},
+	"%": {2, 2, false, arithmetic(math.Mod)},
+	"coalesce": {1, -1, true, func(args []gjson.Result) gjson.Result {
+		for _, arg := range args {
+			if arg.Type != gjson.Null {
+				return arg
+			}
+		}
+
+		return gjson.Result{}
+	}},
+	"json_array_length":  {1, 1, false, arrayLength},
+	"jsonb_array_length": {1, 1, false, arrayLength},
+}
+
+// arithmetic wraps an operator such as + in a scalarFunction, returning NULL for values that aren't numbers and for
+// division by zero.
+func arithmetic(operator func(a, b float64) float64) func(args []gjson.Result) gjson.Result {
+	return func(args []gjson.Result) gjson.Result {
+		a, okA := toNumber(args[0])
+		b, okB := toNumber(args[1])
+		if !okA || !okB {
+			return gjson.Result{}
+		}
+
+		result := operator(a, b)
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return gjson.Result{}
+		}
+
+		return numberValue(result)
+	}
+}
+
+func stringValue(s string) gjson.Result {
+	raw, _ := json.Marshal(s)
+	return gjson.Result{Type: gjson.String, Str: s, Raw: string(raw)}
+}
+
+func numberValue(f float64) gjson.Result {
+	return gjson.Result{Type: gjson.Number, Num: f, Raw: strconv.FormatFloat(f, 'f', -1, 64)}
+}
+
+func boolValue(b bool) gjson.Result {
+	if b {
+		return gjson.Result{Type: gjson.True, Raw: "true"}
+	}
+
+	return gjson.Result{Type: gjson.False, Raw: "false"}
+}
+
+// toNumber returns a value as a number, including numbers that were logged as strings.
+func toNumber(value gjson.Result) (float64, bool) {
+	switch value.Type {
+	case gjson.Number:
+		return value.Num, true
+	case gjson.String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value.Str), 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// substring follows Postgres' substring(string, start, count), where start is 1 based and may be before the start of
+// the string.
+func substring(args []gjson.Result) gjson.Result {
+	runes := []rune(args[0].String())
+	start, ok := toNumber(args[1])
+	if !ok {
+		return gjson.Result{}
+	}
+
+	end := math.Inf(1)
+	if len(args) == 3 {
+		count, ok := toNumber(args[2])
+		if !ok || count < 0 {
+			return gjson.Result{}
+		}
+		end = start + count
+	}
+
+	from := int(math.Max(start, 1)) - 1
+	to := len(runes)
+	if end-1 < float64(to) {
+		to = int(end) - 1
+	}
+
+	if from >= len(runes) || to <= from {
+		return stringValue("")
+	}
+
+	return stringValue(string(runes[from:to]))
+}
+
+func castValue(value gjson.Result, castType string) gjson.Result {
+	switch castType {
+	case "int":
+		if f, ok := toNumber(value); ok {
+			return numberValue(math.Round(f))
+		}
+		if value.Type == gjson.True {
+			return numberValue(1)
+		}
+		if value.Type == gjson.False {
+			return numberValue(0)
+		}
+	case "float":
+		if f, ok := toNumber(value); ok {
+			return numberValue(f)
+		}
+	case "text":
+		return stringValue(value.String())
+	case "bool":
+		switch strings.ToLower(strings.TrimSpace(value.String())) {
+		case "true", "t", "yes", "y", "on", "1":
+			return boolValue(true)
+		case "false", "f", "no", "n", "off", "0":
+			return boolValue(false)
+		}
+	}
+
+	return gjson.Result{}
+}
+
+// Expression is a value computed from a log line, which is either a key, a constant, or a function called with other
+// expressions as arguments.
+type Expression struct {
+	Name     string // Column name when selected
+	KeyPath  string
+	Constant *gjson.Result
+	Function string
+	CastType string // Set when Function is cast
+	Args     []*Expression
+	Cases    []ExpressionCase // Set when Function is case, where Args holds the ELSE result if there is one
+}
+
+// ExpressionCase is a single WHEN condition of a CASE expression, along with its result.
+type ExpressionCase struct {
+	When *QueryNode
+	Then *Expression
+}
+
+// Eval computes the expression's value for a log line, returning a null result for NULL.
+func (e *Expression) Eval(line []byte) gjson.Result {
+	switch {
+	case e.Constant != nil:
+		return *e.Constant
+	case e.KeyPath == RawKey:
+		return stringValue(string(rawLine(line)))
+	case e.KeyPath != "":
+		return gjson.GetBytes(line, e.KeyPath)
+	}
+
+	if e.Function == "case" {
+		for idx := range e.Cases {
+			if match, _ := processNode(e.Cases[idx].When, &line); match {
+				return e.Cases[idx].Then.Eval(line)
+			}
+		}
+
+		if len(e.Args) > 0 {
+			return e.Args[0].Eval(line)
+		}
+		return gjson.Result{}
+	}
+
+	args := make([]gjson.Result, len(e.Args))
+	for idx, arg := range e.Args {
+		args[idx] = arg.Eval(line)
+	}
+
+	if e.Function == "cast" {
+		if args[0].Type == gjson.Null {
+			return gjson.Result{}
+		}
+		return castValue(args[0], e.CastType)
+	}
+
+	function := scalarFunctions[e.Function]
+	if !function.nullSafe {
+		for idx := range args {
+			if args[idx].Type == gjson.Null {
+				return gjson.Result{}
+			}
+		}
+	}
+
+	return function.call(args)
+}
+
+// isScalarFunction returns true if the function is in the registry of scalar functions.
+func isScalarFunction(funcType string) bool {
+	_, ok := scalarFunctions[funcType]
+	return ok
+}
+
+func (qp *QueryParams) handleFunctionExpression(funcType string, argNodes []pgNodes.Node) *Expression {
+	function, ok := scalarFunctions[funcType]
+	if !ok {
+		logger.Log.Panicf("%s is not a supported function", funcType)
+	}
+
+	if len(argNodes) < function.minArgs || (function.maxArgs != -1 && len(argNodes) > function.maxArgs) {
+		logger.Log.Panicf("%s was called with the wrong amount of arguments", funcType)
+	}
+
+	expression := &Expression{Name: funcType, Function: funcType}
+	for _, argNode := range argNodes {
+		expression.Args = append(expression.Args, qp.handleExpression(argNode))
+	}
+
+	return expression
+}
+
+// handleCondition converts a condition used outside of the WHERE clause, such as CASE WHEN and FILTER (WHERE), to a
+// tree matched against each line.
+func (qp *QueryParams) handleCondition(node pgNodes.Node, clause string) *QueryNode {
+	condition := qp.handleExpr(node)
+	walkParams(condition, func(param *QueryParam) {
+		if param.KeyPath == "date" {
+			logger.Log.Panicf("date can't be compared within %s", clause)
+		}
+		if param.Subquery != nil {
+			logger.Log.Panicf("IN (SELECT ...) is only supported in WHERE")
+		}
+	})
+
+	return condition
+}
+
+// handleCaseExpression handles CASE WHEN line.level >= 50 THEN 1 ELSE 0 END, as well as the short form comparing a
+// single value, CASE line.level WHEN 50 THEN 'error' END.
+func (qp *QueryParams) handleCaseExpression(node pgNodes.CaseExpr) *Expression {
+	expression := &Expression{Name: "case", Function: "case"}
+	for _, whenNode := range node.Args.Items {
+		when := whenNode.(pgNodes.CaseWhen)
+		condition := when.Expr
+		if node.Arg != nil {
+			condition = pgNodes.A_Expr{
+				Kind:  pgNodes.AEXPR_OP,
+				Name:  pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: "="}}},
+				Lexpr: node.Arg,
+				Rexpr: when.Expr,
+			}
+		}
+
+		expression.Cases = append(expression.Cases, ExpressionCase{
+			When: qp.handleCondition(condition, "CASE WHEN"),
+			Then: qp.handleExpression(when.Result),
+		})
+	}
+
+	if node.Defresult != nil {
+		expression.Args = []*Expression{qp.handleExpression(node.Defresult)}
+	}
+
+	return expression
+}
+
+// handleExpression converts a node from the select list or WHERE clause to an Expression.
+func (qp *QueryParams) handleExpression(node pgNodes.Node) *Expression {
+	switch node := node.(type) {
+	case pgNodes.ColumnRef:
+		keyPath := qp.getSelectNodeString(node)
+		return &Expression{Name: keyNameFromPath(keyPath), KeyPath: keyPath}
+
+	case pgNodes.A_Const:
+		value, literalType := qp.convertLiteral(node)
+		constant := stringValue(value)
+		switch literalType {
+		case literalNumber:
+			f, _ := strconv.ParseFloat(value, 64)
+			constant = numberValue(f)
+		case literalNull:
+			constant = gjson.Result{}
+		}
+		return &Expression{Constant: &constant}
+
+	case pgNodes.FuncCall:
+		return qp.handleFunctionExpression(getFuncName(node), node.Args.Items)
+
+	case pgNodes.CoalesceExpr:
+		return qp.handleFunctionExpression("coalesce", node.Args.Items)
+
+	case pgNodes.CaseExpr:
+		return qp.handleCaseExpression(node)
+
+	case pgNodes.A_Expr:
+		operator := node.Name.Items[0].(pgNodes.String).Str
+		if node.Kind != pgNodes.AEXPR_OP || !dry.StringListContains(arithmeticOperators, operator) {
+			break
+		}
+
+		// Unary minus, such as -line.offset.
+		if node.Lexpr == nil {
+			zero := numberValue(0)
+			return &Expression{Name: "?column?", Function: operator, Args: []*Expression{{Constant: &zero}, qp.handleExpression(node.Rexpr)}}
+		}
+
+		expression := qp.handleFunctionExpression(operator, []pgNodes.Node{node.Lexpr, node.Rexpr})
+		expression.Name = "?column?"
+		return expression
+
+	case pgNodes.TypeCast:
+		typeName := ""
+		if node.TypeName != nil && len(node.TypeName.Names.Items) > 0 {
+			typeName = node.TypeName.Names.Items[len(node.TypeName.Names.Items)-1].(pgNodes.String).Str
+		}
+
+		// true and false are parsed as 't'::bool and 'f'::bool.
+		if typeName == "bool" {
+			if _, ok := node.Arg.(pgNodes.A_Const); ok {
+				value, _ := qp.convertLiteral(node)
+				constant := boolValue(value == "true")
+				return &Expression{Constant: &constant}
+			}
+		}
+
+		castType, ok := castTypes[typeName]
+		if !ok {
+			logger.Log.Panicf("Casting to %s is not supported", typeName)
+		}
+
+		return &Expression{Name: typeName, Function: "cast", CastType: castType, Args: []*Expression{qp.handleExpression(node.Arg)}}
+	}
+
+	logger.Log.Panicf("Expressions only support keys, constants, arithmetic, and the functions %s", strings.Join(scalarFunctionNames(), ", "))
+	return nil
+}
+
+func scalarFunctionNames() []string {
+	names := []string{"case", "cast"}
+	for name := range scalarFunctions {
+		if !dry.StringListContains(arithmeticOperators, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
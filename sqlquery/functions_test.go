@@ -0,0 +1,170 @@
+package sqlquery
+
+import (
+	"testing"
+
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/tidwall/gjson"
+)
+
+func testConst(value interface{}) pgNodes.A_Const {
+	switch value := value.(type) {
+	case int:
+		return pgNodes.A_Const{Val: pgNodes.Integer{Ival: int64(value)}}
+	case string:
+		return pgNodes.A_Const{Val: pgNodes.String{Str: value}}
+	}
+
+	return pgNodes.A_Const{Val: pgNodes.Null{}}
+}
+
+func testTypeCast(arg pgNodes.Node, typeName string) pgNodes.TypeCast {
+	return pgNodes.TypeCast{Arg: arg, TypeName: &pgNodes.TypeName{Names: pgNodes.List{Items: []pgNodes.Node{
+		pgNodes.String{Str: "pg_catalog"},
+		pgNodes.String{Str: typeName},
+	}}}}
+}
+
+var testFunctionLine = []byte(`{"line":{"name":"Ünïcode Name","path":"/a/b/c","n":"42.6","nil":null,"flag":"yes"}}`)
+
+func TestScalarFunctions(t *testing.T) {
+	sql := "select line.name, line.path, line.n, line.nil, line.flag, line.missing from app where 'x' = '/'"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+
+	name := testColumnRef("line", "name")
+	tests := []struct {
+		name string
+		node pgNodes.Node
+		want string // Raw JSON of the result, empty for NULL
+	}{
+		{"lower", testFuncCall("lower", name), `"ünïcode name"`},
+		{"upper", testFuncCall("upper", name), `"ÜNÏCODE NAME"`},
+		{"length", testFuncCall("length", name), `12`},
+		{"substring", testFuncCall("substring", name, testConst(3), testConst(4)), `"ïcod"`},
+		{"substring before the start", testFuncCall("substring", name, testConst(-1), testConst(4)), `"Ün"`},
+		{"substring to the end", testFuncCall("substring", name, testConst(9)), `"Name"`},
+		{"split_part", testFuncCall("split_part", testColumnRef("line", "path"), testConst("/"), testConst(3)), `"b"`},
+		{"split_part past the end", testFuncCall("split_part", testColumnRef("line", "path"), testConst("/"), testConst(9)), `""`},
+		{"coalesce", pgNodes.CoalesceExpr{Args: pgNodes.List{Items: []pgNodes.Node{testColumnRef("line", "nil"), testColumnRef("line", "missing"), name}}}, `"Ünïcode Name"`},
+		{"cast to int", testTypeCast(testColumnRef("line", "n"), "int4"), `43`},
+		{"cast to float", testTypeCast(testColumnRef("line", "n"), "float8"), `42.6`},
+		{"cast to bool", testTypeCast(testColumnRef("line", "flag"), "bool"), `true`},
+		{"cast to text", testTypeCast(testFuncCall("length", name), "text"), `"12"`},
+		{"invalid cast", testTypeCast(name, "int4"), ``},
+		{"NULL argument", testFuncCall("lower", testColumnRef("line", "nil")), ``},
+		{"missing argument", testFuncCall("length", testColumnRef("line", "missing")), ``},
+	}
+
+	for _, test := range tests {
+		if got := qp.handleExpression(test.node).Eval(testFunctionLine); got.Raw != test.want {
+			t.Errorf("%s = %s, want %s", test.name, got.Raw, test.want)
+		}
+	}
+}
+
+// NULL constants are a typed null, rather then an unsupported constant.
+func TestNullConstants(t *testing.T) {
+	sql := "select line.n, line.nil from app where 'x' = '42.6'"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+
+	expressions := []struct {
+		name string
+		node pgNodes.Node
+		want string
+	}{
+		{"coalesce(x, NULL)", pgNodes.CoalesceExpr{Args: pgNodes.List{Items: []pgNodes.Node{testColumnRef("line", "nil"), testConst(nil)}}}, ``},
+		{"coalesce(NULL, 'x')", pgNodes.CoalesceExpr{Args: pgNodes.List{Items: []pgNodes.Node{testConst(nil), testConst("x")}}}, `"x"`},
+		{"CASE ... ELSE NULL", pgNodes.CaseExpr{
+			Args: pgNodes.List{Items: []pgNodes.Node{pgNodes.CaseWhen{
+				Expr: pgNodes.A_Expr{
+					Kind:  pgNodes.AEXPR_OP,
+					Name:  pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: "="}}},
+					Lexpr: testColumnRef("line", "n"),
+					Rexpr: testConst("x"),
+				},
+				Result: testConst(1),
+			}}},
+			Defresult: testConst(nil),
+		}, ``},
+		{"NULL::int", testTypeCast(testConst(nil), "int4"), ``},
+		{"length(NULL)", testFuncCall("length", testConst(nil)), ``},
+	}
+
+	for _, test := range expressions {
+		got := qp.handleExpression(test.node).Eval(testFunctionLine)
+		if got.Raw != test.want || (test.want == "" && got.Type != gjson.Null) {
+			t.Errorf("%s = %s, want %s", test.name, got.Raw, test.want)
+		}
+	}
+
+	compare := func(value pgNodes.Node) *QueryNode {
+		return qp.handleCompareExpr(pgNodes.A_Expr{
+			Kind:  pgNodes.AEXPR_OP,
+			Name:  pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: "="}}},
+			Lexpr: testColumnRef("line", "n"),
+			Rexpr: value,
+		})
+	}
+
+	other := []byte(`{"line":{"n":"1"}}`)
+	conditions := []struct {
+		name  string
+		node  *QueryNode
+		line  []byte
+		match bool
+		known bool
+	}{
+		{"= NULL", compare(testConst(nil)), testFunctionLine, false, false},
+		{"= NULL::text", compare(testTypeCast(testConst(nil), "text")), testFunctionLine, false, false},
+		{"IN ('42.6', NULL) on a match", compare(pgNodes.List{Items: []pgNodes.Node{testConst("42.6"), testConst(nil)}}), testFunctionLine, true, true},
+		{"IN ('42.6', NULL) on another value", compare(pgNodes.List{Items: []pgNodes.Node{testConst("42.6"), testConst(nil)}}), other, false, false},
+		{"NOT IN ('42.6', NULL) on another value", newBoolNode(BoolNot, compare(pgNodes.List{Items: []pgNodes.Node{testConst("42.6"), testConst(nil)}})), other, false, false},
+	}
+
+	for _, test := range conditions {
+		line := test.line
+		if match, known := processNode(test.node, &line); match != test.match || known != test.known {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, match, known, test.match, test.known)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	sql := "select line.start, line.end, line.bytes, line.text, line.nil from app"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+	line := []byte(`{"line":{"start":100,"end":"350","bytes":2048,"text":"abc","nil":null}}`)
+
+	operator := func(name string, left, right pgNodes.Node) pgNodes.A_Expr {
+		return pgNodes.A_Expr{Kind: pgNodes.AEXPR_OP, Name: pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: name}}}, Lexpr: left, Rexpr: right}
+	}
+	start, end, bytes := testColumnRef("line", "start"), testColumnRef("line", "end"), testColumnRef("line", "bytes")
+
+	tests := []struct {
+		name string
+		node pgNodes.Node
+		want string
+	}{
+		{"end - start", operator("-", end, start), `250`},
+		{"start + 1", operator("+", start, testConst(1)), `101`},
+		{"bytes / 1024", operator("/", bytes, testConst(1024)), `2`},
+		{"start * 1.5", operator("*", start, pgNodes.A_Const{Val: pgNodes.Float{Str: "1.5"}}), `150`},
+		{"end % 100", operator("%", end, testConst(100)), `50`},
+		{"-start", operator("-", nil, start), `-100`},
+		{"(end - start) * 2", operator("*", operator("-", end, start), testConst(2)), `500`},
+		{"division by zero", operator("/", start, testConst(0)), ``},
+		{"string operand", operator("+", testColumnRef("line", "text"), testConst(1)), ``},
+		{"NULL operand", operator("+", testColumnRef("line", "nil"), testConst(1)), ``},
+	}
+
+	for _, test := range tests {
+		if got := qp.handleExpression(test.node).Eval(line); got.Raw != test.want {
+			t.Errorf("%s = %s, want %s", test.name, got.Raw, test.want)
+		}
+	}
+
+	// WHERE line.end - line.start > 200
+	node := qp.handleCompareExpr(operator(">", operator("-", end, start), testConst(200)))
+	if match, known := processNode(node, &line); !match || !known {
+		t.Errorf("line.end - line.start > 200 didn't match %s", line)
+	}
+}
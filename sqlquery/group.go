@@ -0,0 +1,422 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busbud/tidalwave/logger"
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	dry "github.com/ungerik/go-dry"
+)
+
+// List of supported aggregate functions in GROUP BY queries
+var aggregateFunctions = []string{"count", "sum", "avg", "min", "max", "percentile_cont", "percentile_disc", "histogram", "approx_count_distinct"}
+
+// List of precisions supported by date_trunc
+var dateTruncUnits = []string{"second", "minute", "hour", "day", "week", "month", "year"}
+
+// Matches shorthand percentile functions such as p5, p50, p95, p99 and p999.
+var percentileShorthand = regexp.MustCompile(`^p([0-9]+)$`)
+
+const (
+	// FunctionPercentile is the aggregate function name used for percentile_cont, percentile_disc, and shorthands such as p99.
+	FunctionPercentile = "percentile"
+	// FunctionHistogram is the aggregate function name for histogram(key, bucket_width).
+	FunctionHistogram = "histogram"
+	// FunctionApproxCountDistinct is the aggregate function name for approx_count_distinct(key), which estimates the
+	// amount of distinct values with a HyperLogLog sketch rather then holding every value in memory.
+	FunctionApproxCountDistinct = "approx_count_distinct"
+)
+
+// Column is a single selected column of a GROUP BY query, either outputting one of the GROUP BY keys or the result of
+// an aggregate function.
+type Column struct {
+	Name       string
+	KeyPath    string      // Empty for COUNT(*) and aggregates of expressions
+	Expression *Expression // Aggregated instead of KeyPath, such as SUM(CASE WHEN line.level >= 50 THEN 1 ELSE 0 END)
+	Filter     *QueryNode  // Condition of FILTER (WHERE ...), which lines must match to be aggregated
+	Function   string      // Empty when the column is a GROUP BY key
+	Distinct   bool
+	FuncArg    float64 // Percentile or bucket width passed to percentile and histogram functions
+	GroupIdx   int     // Index in GroupBy when the column is a GROUP BY key, otherwise -1
+	Hidden     bool    // Only used by HAVING or ORDER BY, and left out of the results
+}
+
+// IsAggregate returns true if the column is the result of an aggregate function.
+func (c *Column) IsAggregate() bool {
+	return c.Function != ""
+}
+
+// CountsLines returns true for COUNT(*), which counts every line rather then the values of a key.
+func (c *Column) CountsLines() bool {
+	return c.KeyPath == "" && c.Expression == nil
+}
+
+// MatchesFilter returns true if a line is aggregated by the column, which is every line unless it has a FILTER clause.
+func (c *Column) MatchesFilter(line *[]byte) bool {
+	if c.Filter == nil {
+		return true
+	}
+
+	match, _ := processNode(c.Filter, line)
+	return match
+}
+
+func keyNameFromPath(keyPath string) string {
+	keySplit := strings.Split(keyPath, ".")
+	return keySplit[len(keySplit)-1]
+}
+
+// GroupKey is a single GROUP BY key. Keys with a TimeUnit or TimeBucket group lines by their timestamp truncated to
+// the given precision, such as date_trunc('minute', date) or time_bucket('5 minutes', date).
+type GroupKey struct {
+	KeyPath    string
+	TimeUnit   string
+	TimeBucket time.Duration
+	Location   *time.Location // Time zone hours and days of time buckets start in
+}
+
+// IsTime returns true if the key groups lines by time buckets.
+func (k *GroupKey) IsTime() bool {
+	return k.TimeUnit != "" || k.TimeBucket > 0
+}
+
+// Truncate returns the start of the time bucket t belongs to, in the time zone of the key.
+func (k *GroupKey) Truncate(t time.Time) time.Time {
+	location := k.Location
+	if location == nil {
+		location = time.UTC
+	}
+	t = t.In(location)
+
+	// time.Truncate works from the zero time in UTC, so t is shifted by its offset for buckets to start on local hours.
+	truncate := func(d time.Duration) time.Time {
+		_, offset := t.Zone()
+		shift := time.Duration(offset) * time.Second
+		return t.Add(shift).Truncate(d).Add(-shift)
+	}
+
+	if k.TimeBucket > 0 {
+		return truncate(k.TimeBucket)
+	}
+
+	switch k.TimeUnit {
+	case "second":
+		return truncate(time.Second)
+	case "minute":
+		return truncate(time.Minute)
+	case "hour":
+		return truncate(time.Hour)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)) // Weeks start on monday
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, location)
+	default: // day
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	}
+}
+
+// getKeyPath returns the key path for a selected key, where date refers to each line's timestamp.
+func (qp *QueryParams) getKeyPath(columnRef pgNodes.ColumnRef) string {
+	keyPath := qp.getSelectNodeString(columnRef)
+	if keyPath == "date" {
+		return qp.TimestampKey
+	}
+
+	return keyPath
+}
+
+// getTimeGroupKey handles date_trunc('minute', date) and time_bucket('5 minutes', date).
+func (qp *QueryParams) getTimeGroupKey(funcCall pgNodes.FuncCall) (GroupKey, bool) {
+	funcType := getFuncName(funcCall)
+	if funcType != "date_trunc" && funcType != "time_bucket" {
+		return GroupKey{}, false
+	}
+
+	if len(funcCall.Args.Items) != 2 {
+		logger.Log.Panicf("%s requires a precision and a timestamp", funcType)
+	}
+
+	precision := ""
+	if val, ok := funcCall.Args.Items[0].(pgNodes.A_Const); ok {
+		precision = strings.ToLower(qp.repairString(convertAConst(val)))
+	}
+
+	key := GroupKey{KeyPath: qp.getKeyPath(funcCall.Args.Items[1].(pgNodes.ColumnRef)), Location: qp.location()}
+	if funcType == "date_trunc" {
+		if !dry.StringListContains(dateTruncUnits, precision) {
+			logger.Log.Panicf("date_trunc precision %s is not supported", precision)
+		}
+		key.TimeUnit = precision
+	} else {
+		bucket, err := parseInterval(precision)
+		if err != nil || bucket <= 0 {
+			logger.Log.Panicf("time_bucket interval %s is not supported", precision)
+		}
+		key.TimeBucket = bucket
+	}
+
+	return key, true
+}
+
+// getGroupKey returns the GroupKey for a GROUP BY entry, resolving positional references such as GROUP BY 1 to the
+// matching selected column.
+func (qp *QueryParams) getGroupKey(statement *pgNodes.SelectStmt, groupNode pgNodes.Node) GroupKey {
+	switch groupNode := groupNode.(type) {
+	case pgNodes.ColumnRef:
+		return GroupKey{KeyPath: qp.getKeyPath(groupNode)}
+	case pgNodes.FuncCall:
+		if key, ok := qp.getTimeGroupKey(groupNode); ok {
+			return key
+		}
+	case pgNodes.A_Const:
+		position, err := strconv.Atoi(convertAConst(groupNode))
+		if err != nil || position < 1 || position > len(statement.TargetList.Items) {
+			logger.Log.Panicf("GROUP BY position %s is not in select list", convertAConst(groupNode))
+		}
+
+		selectNode := statement.TargetList.Items[position-1].(pgNodes.ResTarget)
+		switch selectNodeVal := selectNode.Val.(type) {
+		case pgNodes.ColumnRef, pgNodes.FuncCall:
+			return qp.getGroupKey(statement, selectNodeVal)
+		}
+	}
+
+	logger.Log.Panicf("GROUP BY only supports keys, date_trunc, time_bucket and select list positions")
+	return GroupKey{}
+}
+
+// getFuncName returns the name of a function without its schema, such as like_escape for pg_catalog.like_escape.
+func getFuncName(funcCall pgNodes.FuncCall) string {
+	return strings.ToLower(funcCall.Funcname.Items[len(funcCall.Funcname.Items)-1].(pgNodes.String).Str)
+}
+
+// usesAggregates returns true when the select list has aggregate functions that aren't handled by the count and
+// distinct query types, in which case the query is processed as a GROUP BY query with a single group. This includes
+// selecting more then one aggregate, FILTER clauses, and aggregates of expressions such as COUNT(CASE ... END).
+func usesAggregates(statement *pgNodes.SelectStmt) bool {
+	aggregates := 0
+	for _, selectNode := range statement.TargetList.Items {
+		funcCall, ok := selectNode.(pgNodes.ResTarget).Val.(pgNodes.FuncCall)
+		if !ok || !isAggregateFunction(getFuncName(funcCall)) {
+			continue
+		}
+
+		if !dry.StringListContains(supportedFunctions, getFuncName(funcCall)) || funcCall.AggFilter != nil {
+			return true
+		}
+
+		for _, arg := range funcCall.Args.Items {
+			if _, ok := arg.(pgNodes.ColumnRef); !ok {
+				return true
+			}
+		}
+
+		aggregates++
+	}
+
+	return aggregates > 1
+}
+
+func isAggregateFunction(funcType string) bool {
+	return dry.StringListContains(aggregateFunctions, funcType) || percentileShorthand.MatchString(funcType)
+}
+
+// convertFuncArg returns the numeric constant passed as an argument to an aggregate function.
+func convertFuncArg(funcType string, node pgNodes.Node) float64 {
+	if val, ok := node.(pgNodes.A_Const); ok {
+		if f, err := strconv.ParseFloat(convertAConst(val), 64); err == nil {
+			return f
+		}
+	}
+
+	logger.Log.Panicf("%s requires a numeric argument", funcType)
+	return 0
+}
+
+// percentileShorthandValue returns the percentile of a shorthand function, where its digits are a percentage. p5 is
+// 0.05 and p50 is 0.5, and digits past the first two are decimals of p99 such as p999 for 0.999.
+func percentileShorthandValue(funcType string) float64 {
+	digits := percentileShorthand.FindStringSubmatch(funcType)[1]
+	if len(digits) == 1 {
+		digits = "0" + digits
+	}
+
+	value, _ := strconv.ParseFloat("0."+digits, 64)
+	if value == 0 || (len(digits) > 2 && !strings.HasPrefix(digits, "99")) {
+		logger.Log.Panicf("%s is not a supported percentile, shorthands go from p1 to p99 or add decimals to p99 such as p999", funcType)
+	}
+
+	return value
+}
+
+func (qp *QueryParams) handleAggregate(funcCall pgNodes.FuncCall) Column {
+	funcType := getFuncName(funcCall)
+	if !isAggregateFunction(funcType) {
+		logger.Log.Panicf("%s is not a supported aggregate function", funcType)
+	}
+
+	column := Column{
+		Name:     funcType,
+		Function: funcType,
+		Distinct: funcCall.AggDistinct,
+		GroupIdx: -1,
+	}
+
+	switch {
+	case funcType == "percentile_cont" || funcType == "percentile_disc":
+		// percentile_cont(0.99) WITHIN GROUP (ORDER BY line.duration_ms)
+		if len(funcCall.Args.Items) != 1 || len(funcCall.AggOrder.Items) != 1 {
+			logger.Log.Panicf("%s requires a percentile and WITHIN GROUP (ORDER BY key)", funcType)
+		}
+
+		column.Function = FunctionPercentile
+		column.FuncArg = convertFuncArg(funcType, funcCall.Args.Items[0])
+		column.KeyPath = qp.getSelectNodeString(funcCall.AggOrder.Items[0].(pgNodes.SortBy).Node.(pgNodes.ColumnRef))
+
+	case percentileShorthand.MatchString(funcType):
+		// p99(line.duration_ms) is the same as percentile_cont(0.99)
+		column.Function = FunctionPercentile
+		column.FuncArg = percentileShorthandValue(funcType)
+		column.KeyPath = qp.getSelectNodeString(funcCall.Args.Items[0].(pgNodes.ColumnRef))
+
+	case funcType == FunctionHistogram:
+		// histogram(line.duration_ms, 100)
+		if len(funcCall.Args.Items) != 2 {
+			logger.Log.Panicf("histogram requires a key and a bucket width")
+		}
+
+		column.KeyPath = qp.getSelectNodeString(funcCall.Args.Items[0].(pgNodes.ColumnRef))
+		column.FuncArg = convertFuncArg(funcType, funcCall.Args.Items[1])
+		if column.FuncArg <= 0 {
+			logger.Log.Panicf("histogram bucket width must be greater then 0")
+		}
+
+	case funcType == FunctionApproxCountDistinct && len(funcCall.Args.Items) != 1:
+		logger.Log.Panicf("approx_count_distinct requires a key")
+
+	case len(funcCall.Args.Items) > 0:
+		if columnRef, ok := funcCall.Args.Items[0].(pgNodes.ColumnRef); ok {
+			column.KeyPath = qp.getSelectNodeString(columnRef)
+		} else {
+			column.Expression = qp.handleExpression(funcCall.Args.Items[0])
+		}
+	}
+
+	// COUNT(*) FILTER (WHERE line.level >= 50)
+	if funcCall.AggFilter != nil {
+		column.Filter = qp.handleCondition(funcCall.AggFilter, "FILTER")
+	}
+
+	if column.Function == FunctionPercentile && (column.FuncArg < 0 || column.FuncArg > 1) {
+		logger.Log.Panicf("%s percentile must be between 0 and 1", funcType)
+	}
+
+	return column
+}
+
+// handleGroupKeyColumn creates the Column for a selected GROUP BY key.
+func (qp *QueryParams) handleGroupKeyColumn(key GroupKey, name string) Column {
+	column := Column{
+		Name:     name,
+		KeyPath:  key.KeyPath,
+		GroupIdx: -1,
+	}
+
+	for idx := range qp.GroupBy {
+		if qp.GroupBy[idx] == key {
+			column.GroupIdx = idx
+			break
+		}
+	}
+
+	if column.GroupIdx == -1 {
+		logger.Log.Panicf("%s must appear in the GROUP BY clause or be used in an aggregate function", key.KeyPath)
+	}
+
+	return column
+}
+
+// uniqueColumnNames renames selected columns sharing a name with another column, such as two COUNT(*) with different
+// FILTER clauses, to count_1, count_2 and so on so every value is kept in output rows. Names given with AS are never
+// renamed, so the same one can't be given twice.
+func (qp *QueryParams) uniqueColumnNames(aliased []bool) {
+	taken := map[string]bool{}
+	for idx := range qp.Columns {
+		if !aliased[idx] {
+			continue
+		}
+
+		if taken[qp.Columns[idx].Name] {
+			logger.Log.Panicf("%s is selected more then once, each column must have a different name", qp.Columns[idx].Name)
+		}
+		taken[qp.Columns[idx].Name] = true
+	}
+
+	for idx := range qp.Columns {
+		if aliased[idx] {
+			continue
+		}
+
+		name := qp.Columns[idx].Name
+		for suffix := 1; taken[name]; suffix++ {
+			name = qp.Columns[idx].Name + "_" + strconv.Itoa(suffix)
+		}
+		qp.Columns[idx].Name = name
+		taken[name] = true
+	}
+}
+
+// handleGroupBy parses the GROUP BY clause and select list of a grouped query in to GroupBy and Columns. Queries
+// selecting aggregates without a GROUP BY clause are handled here as well, grouping all lines together.
+func (qp *QueryParams) handleGroupBy(statement *pgNodes.SelectStmt) {
+	qp.Type = TypeGroupBy
+
+	for _, groupNode := range statement.GroupClause.Items {
+		key := qp.getGroupKey(statement, groupNode)
+		if key.IsTime() {
+			qp.Type = TypeTimeSeries
+		}
+		qp.GroupBy = append(qp.GroupBy, key)
+	}
+
+	aliased := []bool{}
+	for _, selectNode := range statement.TargetList.Items {
+		selectNode := selectNode.(pgNodes.ResTarget)
+		var column Column
+
+		switch selectNodeVal := selectNode.Val.(type) {
+		case pgNodes.ColumnRef:
+			column = qp.handleGroupKeyColumn(GroupKey{KeyPath: qp.getKeyPath(selectNodeVal)}, keyNameFromPath(qp.getSelectNodeString(selectNodeVal)))
+
+		case pgNodes.FuncCall:
+			if key, ok := qp.getTimeGroupKey(selectNodeVal); ok {
+				column = qp.handleGroupKeyColumn(key, getFuncName(selectNodeVal))
+			} else {
+				column = qp.handleAggregate(selectNodeVal)
+			}
+
+		default:
+			logger.Log.Panicf("GROUP BY queries only support selecting keys and aggregate functions")
+		}
+
+		if selectNode.Name != nil {
+			column.Name = *selectNode.Name
+		}
+
+		qp.Columns = append(qp.Columns, column)
+		aliased = append(aliased, selectNode.Name != nil)
+	}
+	qp.uniqueColumnNames(aliased)
+
+	// A single aggregate without GROUP BY returns a single value, the same as COUNT(*).
+	if len(qp.GroupBy) == 0 && len(qp.Columns) == 1 && qp.Columns[0].Function != FunctionHistogram {
+		qp.Type = TypeAggregate
+	}
+}
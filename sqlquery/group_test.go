@@ -0,0 +1,193 @@
+package sqlquery
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+func TestPercentileShorthandValue(t *testing.T) {
+	tests := []struct {
+		funcType string
+		want     float64
+	}{
+		{"p1", 0.01},
+		{"p5", 0.05},
+		{"p05", 0.05},
+		{"p50", 0.5},
+		{"p95", 0.95},
+		{"p99", 0.99},
+		{"p995", 0.995},
+		{"p999", 0.999},
+		{"p9999", 0.9999},
+	}
+
+	for _, test := range tests {
+		if got := percentileShorthandValue(test.funcType); got != test.want {
+			t.Errorf("percentileShorthandValue(%q) = %v, want %v", test.funcType, got, test.want)
+		}
+	}
+
+	for _, funcType := range []string{"p0", "p00", "p100", "p101", "p500", "p1000"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("percentileShorthandValue(%q) didn't panic", funcType)
+				}
+			}()
+			percentileShorthandValue(funcType)
+		}()
+	}
+}
+
+func TestHandleAggregatePercentileShorthand(t *testing.T) {
+	sql := "select p5(line.duration_ms) from app"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+
+	column := qp.handleAggregate(pgNodes.FuncCall{
+		Funcname: pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: "p5"}}},
+		Args: pgNodes.List{Items: []pgNodes.Node{
+			pgNodes.ColumnRef{Fields: pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: "line"}, pgNodes.String{Str: "duration_ms"}}}},
+		}},
+	})
+
+	if column.Function != FunctionPercentile || column.FuncArg != 0.05 || column.KeyPath != "line.duration_ms" || column.Name != "p5" {
+		t.Errorf("p5(line.duration_ms) = %s(%v) of %q named %q", column.Function, column.FuncArg, column.KeyPath, column.Name)
+	}
+}
+
+func TestGroupKeyTruncate(t *testing.T) {
+	montreal := LoadLocation("America/Montreal")
+	kolkata := LoadLocation("Asia/Kolkata")
+
+	tests := []struct {
+		key  GroupKey
+		time string
+		want string
+	}{
+		{GroupKey{TimeUnit: "minute"}, "2024-01-05T03:04:05.6-05:00", "2024-01-05T08:04:00Z"},
+		{GroupKey{TimeUnit: "day"}, "2024-01-05T03:04:05-05:00", "2024-01-05T00:00:00Z"},
+		{GroupKey{TimeUnit: "day", Location: time.UTC}, "2024-01-05T03:04:05Z", "2024-01-05T00:00:00Z"},
+		{GroupKey{TimeBucket: 15 * time.Minute}, "2024-01-05T03:59:59Z", "2024-01-05T03:45:00Z"},
+
+		// Montreal is UTC-5 in January, and UTC-4 in July.
+		{GroupKey{TimeUnit: "second", Location: montreal}, "2024-01-05T03:04:05.6Z", "2024-01-04T22:04:05-05:00"},
+		{GroupKey{TimeUnit: "hour", Location: montreal}, "2024-01-05T03:04:05Z", "2024-01-04T22:00:00-05:00"},
+		{GroupKey{TimeUnit: "day", Location: montreal}, "2024-01-05T03:04:05Z", "2024-01-04T00:00:00-05:00"},
+		{GroupKey{TimeUnit: "day", Location: montreal}, "2024-01-05T05:00:00Z", "2024-01-05T00:00:00-05:00"},
+		{GroupKey{TimeUnit: "day", Location: montreal}, "2024-07-05T03:59:59Z", "2024-07-04T00:00:00-04:00"},
+		{GroupKey{TimeUnit: "week", Location: montreal}, "2024-01-08T03:00:00Z", "2024-01-01T00:00:00-05:00"},
+		{GroupKey{TimeUnit: "month", Location: montreal}, "2024-02-01T03:00:00Z", "2024-01-01T00:00:00-05:00"},
+		{GroupKey{TimeUnit: "year", Location: montreal}, "2024-01-01T03:00:00Z", "2023-01-01T00:00:00-05:00"},
+		{GroupKey{TimeBucket: 24 * time.Hour, Location: montreal}, "2024-01-05T03:04:05Z", "2024-01-04T00:00:00-05:00"},
+
+		// Days start on the local day through daylight saving time changes.
+		{GroupKey{TimeUnit: "day", Location: montreal}, "2024-03-10T12:00:00Z", "2024-03-10T00:00:00-05:00"},
+		{GroupKey{TimeUnit: "day", Location: montreal}, "2024-11-03T23:00:00Z", "2024-11-03T00:00:00-04:00"},
+		{GroupKey{TimeUnit: "hour", Location: montreal}, "2024-11-03T05:30:00Z", "2024-11-03T01:00:00-04:00"},
+		{GroupKey{TimeUnit: "hour", Location: montreal}, "2024-11-03T06:30:00Z", "2024-11-03T01:00:00-05:00"},
+
+		// Kolkata is UTC+5:30, so its hours start on the half hour in UTC.
+		{GroupKey{TimeUnit: "hour", Location: kolkata}, "2024-01-05T03:04:05Z", "2024-01-05T08:00:00+05:30"},
+		{GroupKey{TimeBucket: 30 * time.Minute, Location: kolkata}, "2024-01-05T03:04:05Z", "2024-01-05T08:30:00+05:30"},
+		{GroupKey{TimeUnit: "day", Location: kolkata}, "2024-01-05T18:30:00Z", "2024-01-06T00:00:00+05:30"},
+	}
+
+	for _, test := range tests {
+		lineTime, err := time.Parse(time.RFC3339Nano, test.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := test.key.Truncate(lineTime).Format(time.RFC3339); got != test.want {
+			t.Errorf("%+v truncated %s to %s, want %s", test.key, test.time, got, test.want)
+		}
+	}
+}
+
+func TestHandleGroupByColumnNames(t *testing.T) {
+	sql := "select count(*) filter (where line.level >= 50), count(*) filter (where line.level < 50), count(*), sum(line.amount) as count_1 from app"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+
+	filter := func(operator string) pgNodes.Node {
+		return pgNodes.A_Expr{
+			Kind:  pgNodes.AEXPR_OP,
+			Name:  pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: operator}}},
+			Lexpr: testColumnRef("line", "level"),
+			Rexpr: pgNodes.A_Const{Val: pgNodes.Integer{Ival: 50}},
+		}
+	}
+	count := func(filter pgNodes.Node) pgNodes.FuncCall {
+		funcCall := testFuncCall("count")
+		funcCall.AggStar = true
+		funcCall.AggFilter = filter
+		return funcCall
+	}
+	alias := "count_1"
+
+	qp.handleGroupBy(&pgNodes.SelectStmt{TargetList: pgNodes.List{Items: []pgNodes.Node{
+		pgNodes.ResTarget{Val: count(filter(">="))},
+		pgNodes.ResTarget{Val: count(filter("<"))},
+		pgNodes.ResTarget{Val: count(nil)},
+		pgNodes.ResTarget{Name: &alias, Val: testFuncCall("sum", testColumnRef("line", "amount"))},
+	}}})
+
+	names := []string{}
+	for idx := range qp.Columns {
+		names = append(names, qp.Columns[idx].Name)
+	}
+	if got := strings.Join(names, ","); got != "count,count_2,count_3,count_1" {
+		t.Errorf("columns were named %s", got)
+	}
+
+	for _, test := range []struct {
+		line []byte
+		want []bool
+	}{
+		{[]byte(`{"line":{"level":60}}`), []bool{true, false, true, true}},
+		{[]byte(`{"line":{"level":30}}`), []bool{false, true, true, true}},
+	} {
+		for idx, want := range test.want {
+			if got := qp.Columns[idx].MatchesFilter(&test.line); got != want {
+				t.Errorf("%s on %s = %v, want %v", qp.Columns[idx].Name, test.line, got, want)
+			}
+		}
+	}
+}
+
+func TestHandleGroupByDuplicateAliases(t *testing.T) {
+	sql := "select count(*) as total, sum(line.amount) as total from app"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+	alias := "total"
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("selecting the same alias twice didn't panic")
+		}
+	}()
+
+	qp.handleGroupBy(&pgNodes.SelectStmt{TargetList: pgNodes.List{Items: []pgNodes.Node{
+		pgNodes.ResTarget{Name: &alias, Val: testFuncCall("count")},
+		pgNodes.ResTarget{Name: &alias, Val: testFuncCall("sum", testColumnRef("line", "amount"))},
+	}}})
+}
+
+// date refers to the timestamp key of the query, which child queries share, rather then the configured default.
+func TestGetKeyPathDate(t *testing.T) {
+	sql := "select date_trunc('hour', date), line.date from app group by 1, 2"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql, TimestampKey: "line.ts"}
+
+	if got := qp.getKeyPath(testColumnRef("date")); got != "line.ts" {
+		t.Errorf("date = %s, want line.ts", got)
+	}
+	if got := qp.getKeyPath(testColumnRef("line", "date")); got != "line.date" {
+		t.Errorf("line.date = %s, want line.date", got)
+	}
+
+	key, ok := qp.getTimeGroupKey(testFuncCall("date_trunc", testConst("hour"), testColumnRef("date")))
+	if !ok || key.KeyPath != "line.ts" || key.TimeUnit != "hour" {
+		t.Errorf("date_trunc('hour', date) = %+v, %v", key, ok)
+	}
+}
@@ -0,0 +1,227 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/busbud/tidalwave/logger"
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// countsDistinct returns true when the select list is a single COUNT(DISTINCT()), which is counted per distinct value
+// rather then grouped.
+func countsDistinct(statement *pgNodes.SelectStmt) bool {
+	if len(statement.TargetList.Items) != 1 {
+		return false
+	}
+
+	funcCall, ok := statement.TargetList.Items[0].(pgNodes.ResTarget).Val.(pgNodes.FuncCall)
+	return ok && getFuncName(funcCall) == "count" && funcCall.AggDistinct
+}
+
+// hasOutputColumns returns true for queries whose results are rows of columns computed once every log file has been
+// merged, which HAVING and ORDER BY are evaluated against.
+func (qp *QueryParams) hasOutputColumns() bool {
+	return qp.Type == TypeGroupBy || qp.Type == TypeTimeSeries || qp.Type == TypeCountDistinct
+}
+
+// sameAggregate returns true if two columns are the result of the same aggregate function. Aggregates of expressions
+// or with a FILTER clause are never considered the same.
+func sameAggregate(a, b *Column) bool {
+	if a.Expression != nil || b.Expression != nil || a.Filter != nil || b.Filter != nil {
+		return false
+	}
+
+	return a.Function == b.Function && a.KeyPath == b.KeyPath && a.Distinct == b.Distinct && a.FuncArg == b.FuncArg
+}
+
+// addHiddenColumn adds a column that isn't selected, but is needed by HAVING or ORDER BY.
+func (qp *QueryParams) addHiddenColumn(column Column) string {
+	column.Name = "__hidden_" + strconv.Itoa(len(qp.Columns))
+	column.Hidden = true
+	qp.Columns = append(qp.Columns, column)
+
+	return columnPath(len(qp.Columns) - 1)
+}
+
+// columnPath returns the key of a column in the rows HAVING and ORDER BY are evaluated against, which are keyed by
+// column index as names may repeat or hold characters that are special to key paths.
+func columnPath(idx int) string {
+	return strconv.Itoa(idx)
+}
+
+// escapePath escapes the characters of a key name that are special to key paths, such as . and ?.
+func escapePath(name string) string {
+	var path strings.Builder
+	for _, char := range name {
+		if strings.ContainsRune(`\.*?|#@`, char) {
+			path.WriteByte('\\')
+		}
+		path.WriteRune(char)
+	}
+
+	return path.String()
+}
+
+// countDistinctColumn returns the output column of a COUNT(DISTINCT()) query a HAVING or ORDER BY term refers to. Each
+// row holds a distinct value under the name of the counted key, along with the amount of lines holding it as count.
+func (qp *QueryParams) countDistinctColumn(node pgNodes.Node) string {
+	keyName := keyNameFromPath(qp.AggrPath)
+
+	switch node := node.(type) {
+	case pgNodes.FuncCall:
+		if getFuncName(node) == "count" && !node.AggDistinct && len(node.Args.Items) == 0 {
+			return "count"
+		}
+	case pgNodes.ColumnRef:
+		switch name := qp.getSelectNodeString(node); name {
+		case "count":
+			return "count"
+		case qp.AggrPath, keyName:
+			return escapePath(keyName)
+		}
+	}
+
+	logger.Log.Panicf("HAVING and ORDER BY of COUNT(DISTINCT()) only support COUNT(*) and the counted key")
+	return ""
+}
+
+// outputColumn returns the key path of the output column a HAVING or ORDER BY term of a grouped query refers to, which
+// is either a select list position, the name of a selected column, a GROUP BY key or an aggregate function. GROUP BY
+// keys and aggregates that aren't selected are added as hidden columns.
+func (qp *QueryParams) outputColumn(statement *pgNodes.SelectStmt, node pgNodes.Node) string {
+	if qp.Type == TypeCountDistinct {
+		return qp.countDistinctColumn(node)
+	}
+
+	switch node := node.(type) {
+	case pgNodes.A_Const:
+		position, err := strconv.Atoi(convertAConst(node))
+		if err != nil || position < 1 || position > len(statement.TargetList.Items) {
+			logger.Log.Panicf("ORDER BY position %s is not in select list", convertAConst(node))
+		}
+		return columnPath(position - 1)
+
+	case pgNodes.ColumnRef:
+		name := qp.getSelectNodeString(node)
+		key := GroupKey{KeyPath: qp.getKeyPath(node)}
+		for idx := range qp.Columns {
+			if !qp.Columns[idx].Hidden && qp.Columns[idx].Name == name {
+				return columnPath(idx)
+			}
+		}
+
+		for idx := range qp.Columns {
+			column := &qp.Columns[idx]
+			if !column.IsAggregate() && qp.GroupBy[column.GroupIdx] == key {
+				return columnPath(idx)
+			}
+		}
+
+		return qp.addHiddenColumn(qp.handleGroupKeyColumn(key, ""))
+
+	case pgNodes.FuncCall:
+		if key, ok := qp.getTimeGroupKey(node); ok {
+			for idx := range qp.Columns {
+				column := &qp.Columns[idx]
+				if !column.IsAggregate() && qp.GroupBy[column.GroupIdx] == key {
+					return columnPath(idx)
+				}
+			}
+
+			return qp.addHiddenColumn(qp.handleGroupKeyColumn(key, ""))
+		}
+
+		aggregate := qp.handleAggregate(node)
+		for idx := range qp.Columns {
+			if qp.Columns[idx].IsAggregate() && sameAggregate(&qp.Columns[idx], &aggregate) {
+				return columnPath(idx)
+			}
+		}
+
+		return qp.addHiddenColumn(aggregate)
+	}
+
+	logger.Log.Panicf("HAVING and ORDER BY of grouped queries only support selected columns, GROUP BY keys and aggregate functions")
+	return ""
+}
+
+// handleHavingExpr builds the HAVING tree, where each comparison is against an output column rather then a key of the
+// log lines.
+func (qp *QueryParams) handleHavingExpr(statement *pgNodes.SelectStmt, node pgNodes.Node) *QueryNode {
+	switch expr := node.(type) {
+	case pgNodes.BoolExpr:
+		operator := BoolAnd
+		switch expr.Boolop {
+		case pgNodes.OR_EXPR:
+			operator = BoolOr
+		case pgNodes.NOT_EXPR:
+			operator = BoolNot
+		}
+
+		having := newBoolNode(operator)
+		for _, child := range expr.Args.Items {
+			having.Nodes = append(having.Nodes, qp.handleHavingExpr(statement, child))
+		}
+		return having
+
+	case pgNodes.NullTest:
+		param := QueryParam{Operator: OperatorIsNull, KeyPath: qp.outputColumn(statement, expr.Arg)}
+		if expr.Nulltesttype == pgNodes.IS_NOT_NULL {
+			param.Operator = OperatorIsNotNull
+		}
+		return newLeafNode(param)
+
+	case pgNodes.A_Expr:
+		if expr.Kind == pgNodes.AEXPR_OP_ANY || expr.Kind == pgNodes.AEXPR_OP_ALL {
+			break
+		}
+
+		operator := strings.ToLower(expr.Name.Items[0].(pgNodes.String).Str)
+		if operator == "<>" {
+			operator = "!="
+		}
+
+		// 100 < COUNT(*) is the same as COUNT(*) > 100.
+		if _, ok := expr.Lexpr.(pgNodes.A_Const); ok {
+			if _, ok := expr.Rexpr.(pgNodes.A_Const); !ok {
+				commuted, ok := commutedOperators[operator]
+				if !ok {
+					logger.Log.Panicf("HAVING only supports the operators =, !=, <, <=, > and >= with a constant on the left")
+				}
+				operator = commuted
+				expr.Lexpr, expr.Rexpr = expr.Rexpr, expr.Lexpr
+			}
+		}
+
+		return qp.handleCompareValue(expr, QueryParam{
+			Operator: operator,
+			KeyPath:  qp.outputColumn(statement, expr.Lexpr),
+		})
+	}
+
+	logger.Log.Panicf("HAVING only supports comparing aggregate functions and selected columns")
+	return nil
+}
+
+// handleHavingClause parses the HAVING clause, which is matched against each output row once the results of every log
+// file have been merged.
+func (qp *QueryParams) handleHavingClause(statement *pgNodes.SelectStmt) {
+	if !qp.hasOutputColumns() && qp.Type != TypeAggregate {
+		logger.Log.Panicf("HAVING is only supported with GROUP BY, aggregate functions and COUNT(DISTINCT())")
+	}
+
+	qp.Having = qp.handleHavingExpr(statement, statement.HavingClause)
+}
+
+// ProcessHaving evaluates the HAVING clause against an output row of a grouped query, which must hold every column
+// including the hidden ones keyed by their index.
+func (qp *QueryParams) ProcessHaving(row *[]byte) bool {
+	if qp.Having == nil {
+		return true
+	}
+
+	match, _ := processNode(qp.Having, row)
+	return match
+}
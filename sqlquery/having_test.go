@@ -0,0 +1,82 @@
+package sqlquery
+
+import (
+	"strings"
+	"testing"
+
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/tidwall/gjson"
+)
+
+func testColumnRef(fields ...string) pgNodes.ColumnRef {
+	items := []pgNodes.Node{}
+	for _, field := range fields {
+		items = append(items, pgNodes.String{Str: field})
+	}
+
+	return pgNodes.ColumnRef{Fields: pgNodes.List{Items: items}}
+}
+
+func testFuncCall(name string, args ...pgNodes.Node) pgNodes.FuncCall {
+	return pgNodes.FuncCall{Funcname: pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: name}}}, Args: pgNodes.List{Items: args}}
+}
+
+// Aggregates of the same function are told apart by their position rather then their name.
+func TestOutputColumn(t *testing.T) {
+	sql := "select sum(line.a), sum(line.b) as total, line.c from app group by line.c having sum(line.b) > 1 order by 1, total, count(*)"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: strings.ToLower(sql), Type: TypeGroupBy, GroupBy: []GroupKey{{KeyPath: "line.c"}}}
+
+	sumA := testFuncCall("sum", testColumnRef("line", "a"))
+	sumB := testFuncCall("sum", testColumnRef("line", "b"))
+	qp.Columns = []Column{qp.handleAggregate(sumA), qp.handleAggregate(sumB), {Name: "c", KeyPath: "line.c", GroupIdx: 0}}
+	qp.Columns[1].Name = "total"
+	statement := &pgNodes.SelectStmt{TargetList: pgNodes.List{Items: []pgNodes.Node{
+		pgNodes.ResTarget{Val: sumA}, pgNodes.ResTarget{Val: sumB}, pgNodes.ResTarget{Val: testColumnRef("line", "c")},
+	}}}
+
+	tests := []struct {
+		node pgNodes.Node
+		want string
+	}{
+		{sumA, "0"},
+		{sumB, "1"},
+		{pgNodes.A_Const{Val: pgNodes.Integer{Ival: 1}}, "0"},
+		{pgNodes.A_Const{Val: pgNodes.Integer{Ival: 2}}, "1"},
+		{testColumnRef("total"), "1"},
+		{testColumnRef("line", "c"), "2"},
+		{testFuncCall("count"), "3"},
+	}
+
+	for _, test := range tests {
+		if got := qp.outputColumn(statement, test.node); got != test.want {
+			t.Errorf("outputColumn(%+v) = %s, want %s", test.node, got, test.want)
+		}
+	}
+
+	if len(qp.Columns) != 4 || !qp.Columns[3].Hidden || qp.Columns[3].Function != "count" {
+		t.Fatalf("COUNT(*) wasn't added as a hidden column: %+v", qp.Columns)
+	}
+
+	qp.Having = qp.handleHavingExpr(statement, pgNodes.A_Expr{
+		Kind:  pgNodes.AEXPR_OP,
+		Name:  pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: ">"}}},
+		Lexpr: sumB,
+		Rexpr: pgNodes.A_Const{Val: pgNodes.Integer{Ival: 1}},
+	})
+
+	for row, want := range map[string]bool{`{"0":5,"1":0,"2":"x","3":1}`: false, `{"0":0,"1":5,"2":"x","3":1}`: true} {
+		line := []byte(row)
+		if got := qp.ProcessHaving(&line); got != want {
+			t.Errorf("HAVING sum(line.b) > 1 on %s = %v, want %v", row, got, want)
+		}
+	}
+}
+
+func TestEscapePath(t *testing.T) {
+	row := `{"?column?":1,"xcolumnx":2,"a.b":3,"a":{"b":4},"c*":5,"cd":6,"#":7,"\\":8}`
+	for name, want := range map[string]int64{"?column?": 1, "xcolumnx": 2, "a.b": 3, "c*": 5, "#": 7, `\`: 8} {
+		if got := gjson.Get(row, escapePath(name)).Int(); got != want {
+			t.Errorf("%s escaped as %s returned %d, want %d", name, escapePath(name), got, want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"strings"
+
+	"github.com/busbud/tidalwave/logger"
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// JoinTable is an app within a query's JOIN clauses. Joined rows hold the line of each app under its alias, such as
+// {"a":{...},"p":{...}}, which the WHERE and SELECT of the query are evaluated against.
+type JoinTable struct {
+	App   string
+	Alias string
+	Where *QueryNode // Conditions of the WHERE clause only referencing this app, checked before lines are joined
+}
+
+// JoinCondition is an ON condition comparing the keys of two joined apps, such as a.line.req_id = p.line.req_id.
+type JoinCondition struct {
+	Left      int    // Index of the app within Joins
+	LeftPath  string // Key of the app's lines, without its alias
+	Right     int
+	RightPath string
+}
+
+// tableIndex returns the index of a joined app from the alias at the start of a key, such as a in a.line.req_id.
+func (qp *QueryParams) tableIndex(keyPath string) (int, string) {
+	for idx := range qp.Joins {
+		if strings.HasPrefix(keyPath, qp.Joins[idx].Alias+".") {
+			return idx, strings.TrimPrefix(keyPath, qp.Joins[idx].Alias+".")
+		}
+	}
+
+	logger.Log.Panicf("%s must start with the alias of a joined app", keyPath)
+	return -1, ""
+}
+
+func (qp *QueryParams) handleJoinTable(node pgNodes.Node) {
+	rangeVar, ok := node.(pgNodes.RangeVar)
+	if !ok {
+		logger.Log.Panicf("JOIN only supports apps")
+	}
+
+	table := JoinTable{App: qp.repairString(*rangeVar.Relname)}
+	table.Alias = table.App
+	if rangeVar.Alias != nil && rangeVar.Alias.Aliasname != nil {
+		table.Alias = qp.repairString(*rangeVar.Alias.Aliasname)
+	}
+
+	for idx := range qp.Joins {
+		if qp.Joins[idx].Alias == table.Alias {
+			logger.Log.Panicf("%s is joined more then once, give each an alias", table.Alias)
+		}
+	}
+
+	qp.Joins = append(qp.Joins, table)
+	qp.From = append(qp.From, table.App)
+}
+
+// handleJoinExpr handles api a JOIN payments p ON a.line.req_id = p.line.req_id, where the left side may be another
+// JOIN. Each ON condition must compare a key of the app being joined with a key of an app joined before it.
+func (qp *QueryParams) handleJoinExpr(expr pgNodes.JoinExpr) {
+	if expr.Jointype != pgNodes.JOIN_INNER || expr.IsNatural {
+		logger.Log.Panicf("Only INNER JOIN is supported")
+	}
+
+	if left, ok := expr.Larg.(pgNodes.JoinExpr); ok {
+		qp.handleJoinExpr(left)
+	} else {
+		qp.handleJoinTable(expr.Larg)
+	}
+	qp.handleJoinTable(expr.Rarg)
+
+	quals, ok := expr.Quals.(pgNodes.A_Expr)
+	if !ok || quals.Kind != pgNodes.AEXPR_OP || quals.Name.Items[0].(pgNodes.String).Str != "=" {
+		logger.Log.Panicf("JOIN only supports ON conditions comparing two keys with =")
+	}
+
+	leftRef, leftOk := quals.Lexpr.(pgNodes.ColumnRef)
+	rightRef, rightOk := quals.Rexpr.(pgNodes.ColumnRef)
+	if !leftOk || !rightOk {
+		logger.Log.Panicf("JOIN only supports ON conditions comparing two keys with =")
+	}
+
+	condition := JoinCondition{}
+	condition.Left, condition.LeftPath = qp.tableIndex(qp.getSelectNodeString(leftRef))
+	condition.Right, condition.RightPath = qp.tableIndex(qp.getSelectNodeString(rightRef))
+
+	joined := len(qp.Joins) - 1
+	if condition.Left == joined {
+		condition.Left, condition.Right = condition.Right, condition.Left
+		condition.LeftPath, condition.RightPath = condition.RightPath, condition.LeftPath
+	}
+
+	if condition.Right != joined || condition.Left == joined {
+		logger.Log.Panicf("The ON condition of %s must compare one of its keys with a key of an app joined before it", qp.Joins[joined].Alias)
+	}
+
+	qp.JoinConditions = append(qp.JoinConditions, condition)
+}
+
+// paramTable returns the index of the only joined app a param's key refers to, or -1 for params referring to functions
+// of keys.
+func (qp *QueryParams) paramTable(param *QueryParam) int {
+	if param.Expression != nil || param.Subquery != nil || param.KeyPath == RawKey {
+		return -1
+	}
+
+	idx, _ := qp.tableIndex(param.KeyPath)
+	return idx
+}
+
+// pushDownJoinWhere copies the conditions of the top level AND of the WHERE tree that only refer to a single app to
+// the Where of that app, so lines that can't match are skipped before they're joined and held in memory.
+func (qp *QueryParams) pushDownJoinWhere() {
+	if qp.Where == nil {
+		return
+	}
+
+	nodes := []*QueryNode{qp.Where}
+	if qp.Where.Operator == BoolAnd {
+		nodes = qp.Where.Nodes
+	}
+
+	for _, node := range nodes {
+		if node.Param == nil {
+			continue
+		}
+
+		idx := qp.paramTable(node.Param)
+		if idx == -1 {
+			continue
+		}
+
+		param := *node.Param
+		param.KeyPath = strings.TrimPrefix(param.KeyPath, qp.Joins[idx].Alias+".")
+		if qp.Joins[idx].Where == nil {
+			qp.Joins[idx].Where = newBoolNode(BoolAnd)
+		}
+		qp.Joins[idx].Where.Nodes = append(qp.Joins[idx].Where.Nodes, newLeafNode(param))
+	}
+}
+
+// JoinTableQuery returns the query params used to read the lines of a joined app, filtering lines by date and by the
+// conditions pushed down to the app.
+func (qp *QueryParams) JoinTableQuery(idx int) *QueryParams {
+	return &QueryParams{
+		SQLString:      qp.SQLString,
+		SQLStringLower: qp.SQLStringLower,
+		From:           []string{qp.Joins[idx].App},
+		Location:       qp.Location,
+		Type:           TypeSearch,
+		Limit:          -1,
+		Dates:          qp.Dates,
+		Where:          qp.Joins[idx].Where,
+		With:           qp.With,
+
+		TimestampKey:     qp.TimestampKey,
+		TimestampLayouts: qp.TimestampLayouts,
+
+		prefilters:  rawPrefilters(qp.Joins[idx].Where),
+		timeFilters: qp.timeFilters,
+	}
+}
@@ -0,0 +1,282 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"strings"
+
+	"github.com/busbud/tidalwave/logger"
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/tidwall/gjson"
+)
+
+// OperatorContains matches JSON values containing a JSON constant, such as an object holding every listed key and
+// value, or an array holding every listed element.
+// SELECT * FROM serverapp WHERE line @> '{"status":"failed","request":{"method":"POST"}}'
+const OperatorContains = "@>"
+
+const (
+	// OperatorHasKey matches objects holding a key, or arrays holding a string.
+	// SELECT * FROM serverapp WHERE line ? 'error'
+	OperatorHasKey = "?"
+	// OperatorHasAnyKey matches objects holding any of the keys of an ARRAY constant.
+	OperatorHasAnyKey = "?|"
+	// OperatorHasAllKeys matches objects holding every key of an ARRAY constant.
+	OperatorHasAllKeys = "?&"
+)
+
+const (
+	// QuantifierAny matches when the comparison is true for any element of an array.
+	QuantifierAny = "any"
+	// QuantifierAll matches when the comparison is true for every element of an array.
+	QuantifierAll = "all"
+)
+
+// Operators usable with ANY and ALL, mapped to the operator comparing each element against the constant on the left,
+// as 5 < ANY(line.sizes) is true when an element is > 5.
+var commutedOperators = map[string]string{
+	"=":  "=",
+	"!=": "!=",
+	"<":  ">",
+	">":  "<",
+	"<=": ">=",
+	">=": "<=",
+}
+
+// arrayLength implements jsonb_array_length, returning NULL for values that aren't arrays.
+func arrayLength(args []gjson.Result) gjson.Result {
+	if !args[0].IsArray() {
+		return gjson.Result{}
+	}
+
+	return numberValue(float64(len(args[0].Array())))
+}
+
+// parseJSONLiteral parses the JSON constant compared against by @>.
+func parseJSONLiteral(value string) gjson.Result {
+	if !gjson.Valid(value) {
+		logger.Log.Panicf("%s is not valid JSON", value)
+	}
+
+	return gjson.Parse(value)
+}
+
+// jsonEqual returns true if two scalar JSON values are equal, comparing numbers by value.
+func jsonEqual(a, b gjson.Result) bool {
+	if a.Type != b.Type {
+		return false
+	}
+
+	switch a.Type {
+	case gjson.Number:
+		return a.Num == b.Num
+	case gjson.String:
+		return a.Str == b.Str
+	case gjson.JSON:
+		return a.Raw == b.Raw
+	}
+
+	return true
+}
+
+// jsonContains follows Postgres' jsonb containment, where objects contain objects holding a subset of their keys,
+// arrays contain arrays whose every element is contained by one of their elements, and scalars contain equal scalars.
+func jsonContains(value, contained gjson.Result) bool {
+	switch {
+	case contained.IsObject():
+		if !value.IsObject() {
+			return false
+		}
+
+		values := value.Map()
+		match := true
+		contained.ForEach(func(key, containedValue gjson.Result) bool {
+			keyValue, ok := values[key.Str]
+			match = ok && jsonContains(keyValue, containedValue)
+			return match
+		})
+		return match
+
+	case contained.IsArray():
+		if !value.IsArray() {
+			return false
+		}
+
+		elements := value.Array()
+		for _, containedElement := range contained.Array() {
+			found := false
+			for _, element := range elements {
+				if jsonContains(element, containedElement) {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+
+	return !value.IsObject() && !value.IsArray() && jsonEqual(value, contained)
+}
+
+// processContains handles @>, where as in Postgres an array also contains a single scalar equal to one of its
+// elements.
+func processContains(q *QueryParam, value gjson.Result) bool {
+	if value.IsArray() && !q.ValJSON.IsObject() && !q.ValJSON.IsArray() {
+		for _, element := range value.Array() {
+			if jsonEqual(element, q.ValJSON) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return jsonContains(value, q.ValJSON)
+}
+
+// hasKey returns true if an object has a top level key, or if an array has a string element equal to key.
+func hasKey(value gjson.Result, key string) bool {
+	found := false
+	switch {
+	case value.IsObject():
+		value.ForEach(func(objectKey, _ gjson.Result) bool {
+			found = objectKey.Str == key
+			return !found
+		})
+	case value.IsArray():
+		value.ForEach(func(_, element gjson.Result) bool {
+			found = element.Type == gjson.String && element.Str == key
+			return !found
+		})
+	default:
+		found = value.Type == gjson.String && value.Str == key
+	}
+
+	return found
+}
+
+// processHasKeys handles ?, ?| and ?&.
+func processHasKeys(q *QueryParam, value gjson.Result) bool {
+	if q.Operator == OperatorHasKey {
+		return hasKey(value, q.ValString)
+	}
+
+	for _, key := range q.ValStringArray {
+		found := hasKey(value, key)
+		if q.Operator == OperatorHasAnyKey && found {
+			return true
+		}
+		if q.Operator == OperatorHasAllKeys && !found {
+			return false
+		}
+	}
+
+	return q.Operator == OperatorHasAllKeys
+}
+
+// processQuantified compares the constant of an ANY or ALL comparison against each element of an array. Like
+// Postgres, NULL elements make the result unknown unless another element decides it.
+func processQuantified(q *QueryParam, value gjson.Result) (match, known bool) {
+	if !value.IsArray() {
+		return false, false
+	}
+
+	known = true
+	for _, element := range value.Array() {
+		if element.Type == gjson.Null {
+			known = false
+			continue
+		}
+
+		elementMatch := processValue(q, element)
+		if q.Quantifier == QuantifierAny && elementMatch {
+			return true, true
+		}
+		if q.Quantifier == QuantifierAll && !elementMatch {
+			return false, true
+		}
+	}
+
+	if !known {
+		return false, false
+	}
+
+	return q.Quantifier == QuantifierAll, true
+}
+
+// handleQuantifiedExpr handles ANY and ALL. Comparing against a JSON array on the line puts the constant on the left
+// ('admin' = ANY(line.roles)), where comparing a key against an ARRAY constant is the same as IN
+// (line.level = ANY(ARRAY[50, 60])).
+func (qp *QueryParams) handleQuantifiedExpr(expr pgNodes.A_Expr, operator string) *QueryNode {
+	quantifier := QuantifierAny
+	if expr.Kind == pgNodes.AEXPR_OP_ALL {
+		quantifier = QuantifierAll
+	}
+
+	if array, ok := expr.Rexpr.(pgNodes.A_ArrayExpr); ok {
+		in := pgNodes.A_Expr{
+			Kind:  pgNodes.AEXPR_OP,
+			Name:  pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: "="}}},
+			Lexpr: expr.Lexpr,
+			Rexpr: array.Elements,
+		}
+
+		switch {
+		case quantifier == QuantifierAny && operator == "=":
+			return qp.handleCompareExpr(in)
+		case quantifier == QuantifierAll && operator == "!=":
+			return newBoolNode(BoolNot, qp.handleCompareExpr(in))
+		}
+
+		logger.Log.Panicf("ARRAY constants only support = ANY and != ALL")
+	}
+
+	commuted, ok := commutedOperators[operator]
+	if !ok {
+		logger.Log.Panicf("ANY and ALL only support the operators =, !=, <, <=, > and >=")
+	}
+
+	param := QueryParam{Operator: commuted, Quantifier: quantifier}
+	if columnRef, ok := expr.Rexpr.(pgNodes.ColumnRef); ok {
+		param.KeyPath = qp.getSelectNodeString(columnRef)
+	} else {
+		param.Expression = qp.handleExpression(expr.Rexpr)
+	}
+
+	if param.KeyPath == RawKey {
+		logger.Log.Panicf("%s is not an array", RawKey)
+	}
+
+	return newLeafNode(qp.assignTypeFieldsToParam(param, expr.Lexpr))
+}
+
+// KeyValues returns the values of a key on a log line. Keys containing # such as line.tags.# or line.items.#.id are
+// unnested, returning each element of the array rather then the array itself.
+func KeyValues(line []byte, keyPath string) []gjson.Result {
+	depth := 0
+	for _, part := range strings.Split(keyPath, ".") {
+		if part == "#" {
+			depth++
+		}
+	}
+
+	if depth == 0 {
+		return []gjson.Result{gjson.GetBytes(line, keyPath)}
+	}
+
+	// gjson returns the length of the array for line.tags.#, so the array itself is read instead.
+	values := []gjson.Result{gjson.GetBytes(line, strings.TrimSuffix(keyPath, ".#"))}
+	for ; depth > 0; depth-- {
+		elements := []gjson.Result{}
+		for _, value := range values {
+			if value.IsArray() {
+				elements = append(elements, value.Array()...)
+			}
+		}
+		values = elements
+	}
+
+	return values
+}
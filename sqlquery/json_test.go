@@ -0,0 +1,148 @@
+package sqlquery
+
+import (
+	"strings"
+	"testing"
+
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/tidwall/gjson"
+)
+
+// Quotes within a string constant are part of its value, such as the JSON string '"beta"'.
+func TestQuotedStringConstants(t *testing.T) {
+	sql := `select * from app where line.tags @> '"beta"' and line.name = '"Gamma"'`
+	qp := &QueryParams{SQLString: sql, SQLStringLower: strings.ToLower(sql)}
+	constant := func(s string) pgNodes.A_Const { return pgNodes.A_Const{Val: pgNodes.String{Str: s}} }
+
+	contains := qp.assignTypeFieldsToParam(QueryParam{KeyPath: "tags", Operator: OperatorContains}, constant(`"beta"`))
+	equals := qp.assignTypeFieldsToParam(QueryParam{KeyPath: "name", Operator: "="}, constant(`"gamma"`))
+	if contains.ValString != `"beta"` || equals.ValString != `"Gamma"` {
+		t.Fatalf(`'"beta"' and '"Gamma"' were read as %s and %s`, contains.ValString, equals.ValString)
+	}
+
+	tests := []struct {
+		param QueryParam
+		line  string
+		want  bool
+	}{
+		{contains, `{"tags":["alpha","beta"]}`, true},
+		{contains, `{"tags":["alpha"]}`, false},
+		{contains, `{"tags":"beta"}`, true},
+		{equals, `{"name":"\"Gamma\""}`, true},
+		{equals, `{"name":"Gamma"}`, false},
+	}
+
+	for _, test := range tests {
+		param := test.param
+		line := []byte(test.line)
+		if match, _ := processParam(&param, &line); match != test.want {
+			t.Errorf("%s %s %s on %s = %v, want %v", param.KeyPath, param.Operator, param.ValString, test.line, match, test.want)
+		}
+	}
+}
+
+func TestJSONContains(t *testing.T) {
+	tests := []struct {
+		value     string
+		contained string
+		want      bool
+	}{
+		{`{"a":1,"b":{"c":"x","d":2}}`, `{"b":{"c":"x"}}`, true},
+		{`{"a":1,"b":{"c":"x","d":2}}`, `{"a":1.0}`, true},
+		{`{"a":1,"b":{"c":"x","d":2}}`, `{"b":{"c":"y"}}`, false},
+		{`{"a":1}`, `{"a":1,"e":null}`, false},
+		{`{"a":[1,2,3]}`, `{"a":[3,1]}`, true},
+		{`{"a":[1,2,3]}`, `{"a":[4]}`, false},
+		{`[{"id":1,"tags":["x","y"]},{"id":2}]`, `[{"tags":["y"]}]`, true},
+		{`[1,[2,3]]`, `[[3]]`, true},
+		{`"1"`, `1`, false},
+		{`{"a":1}`, `[]`, false},
+		{`[]`, `[]`, true},
+	}
+
+	for _, test := range tests {
+		if got := jsonContains(gjson.Parse(test.value), gjson.Parse(test.contained)); got != test.want {
+			t.Errorf("%s @> %s = %v, want %v", test.value, test.contained, got, test.want)
+		}
+	}
+}
+
+func TestQuantifiedExpr(t *testing.T) {
+	sql := "select * from app where 'admin' = any(line.roles) and 5 < any(line.sizes) and line.level = any(array[50, 60])"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+	quantified := func(kind pgNodes.A_Expr_Kind, operator string, left, right pgNodes.Node) *QueryNode {
+		return qp.handleCompareExpr(pgNodes.A_Expr{
+			Kind:  kind,
+			Name:  pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: operator}}},
+			Lexpr: left,
+			Rexpr: right,
+		})
+	}
+	roles := testColumnRef("line", "roles")
+	sizes := testColumnRef("line", "sizes")
+	levels := pgNodes.A_ArrayExpr{Elements: pgNodes.List{Items: []pgNodes.Node{testConst(50), testConst(60)}}}
+
+	tests := []struct {
+		name  string
+		node  *QueryNode
+		line  string
+		match bool
+		known bool
+	}{
+		{"'admin' = ANY", quantified(pgNodes.AEXPR_OP_ANY, "=", testConst("admin"), roles), `{"line":{"roles":["user","admin"]}}`, true, true},
+		{"'admin' = ANY without a match", quantified(pgNodes.AEXPR_OP_ANY, "=", testConst("admin"), roles), `{"line":{"roles":["user"]}}`, false, true},
+		{"'admin' = ANY with a NULL element", quantified(pgNodes.AEXPR_OP_ANY, "=", testConst("admin"), roles), `{"line":{"roles":["user",null]}}`, false, false},
+		{"'admin' = ANY with a NULL element and a match", quantified(pgNodes.AEXPR_OP_ANY, "=", testConst("admin"), roles), `{"line":{"roles":[null,"admin"]}}`, true, true},
+		{"'admin' = ANY of an empty array", quantified(pgNodes.AEXPR_OP_ANY, "=", testConst("admin"), roles), `{"line":{"roles":[]}}`, false, true},
+		{"'admin' = ANY of a string", quantified(pgNodes.AEXPR_OP_ANY, "=", testConst("admin"), roles), `{"line":{"roles":"admin"}}`, false, false},
+		{"5 < ANY", quantified(pgNodes.AEXPR_OP_ANY, "<", testConst(5), sizes), `{"line":{"sizes":[1,6]}}`, true, true},
+		{"5 < ALL", quantified(pgNodes.AEXPR_OP_ALL, "<", testConst(5), sizes), `{"line":{"sizes":[1,6]}}`, false, true},
+		{"5 < ALL of larger sizes", quantified(pgNodes.AEXPR_OP_ALL, "<", testConst(5), sizes), `{"line":{"sizes":[7,6]}}`, true, true},
+		{"5 < ALL of an empty array", quantified(pgNodes.AEXPR_OP_ALL, "<", testConst(5), sizes), `{"line":{"sizes":[]}}`, true, true},
+		{"level = ANY(ARRAY[50, 60])", quantified(pgNodes.AEXPR_OP_ANY, "=", testColumnRef("line", "level"), levels), `{"line":{"level":60}}`, true, true},
+		{"level != ALL(ARRAY[50, 60])", quantified(pgNodes.AEXPR_OP_ALL, "!=", testColumnRef("line", "level"), levels), `{"line":{"level":60}}`, false, true},
+		{"level != ALL(ARRAY[50, 60]) without a match", quantified(pgNodes.AEXPR_OP_ALL, "!=", testColumnRef("line", "level"), levels), `{"line":{"level":30}}`, true, true},
+	}
+
+	for _, test := range tests {
+		line := []byte(test.line)
+		if match, known := processNode(test.node, &line); match != test.match || known != test.known {
+			t.Errorf("%s on %s: got %v, %v, want %v, %v", test.name, test.line, match, known, test.match, test.known)
+		}
+	}
+}
+
+func TestArrayFunctions(t *testing.T) {
+	line := []byte(`{"line":{"tags":["a","b"],"items":[{"id":1,"parts":[{"n":"x"},{"n":"y"}]},{"id":2,"parts":[]},{"name":"no id"}],"text":"ab"}}`)
+
+	for value, want := range map[string]string{`["a","b"]`: "2", `[]`: "0", `"ab"`: "", `{"a":1}`: ""} {
+		if got := arrayLength([]gjson.Result{gjson.Parse(value)}); got.Raw != want {
+			t.Errorf("jsonb_array_length(%s) = %s, want %s", value, got.Raw, want)
+		}
+	}
+
+	tests := []struct {
+		keyPath string
+		want    string
+	}{
+		{"line.tags", `["a","b"]`},
+		{"line.tags.#", `"a" "b"`},
+		{"line.items.#.id", `1 2`},
+		{"line.items.#.parts.#.n", `"x" "y"`},
+		{"line.text.#", ``},
+		{"line.missing.#", ``},
+	}
+
+	for _, test := range tests {
+		values := []string{}
+		for _, value := range KeyValues(line, test.keyPath) {
+			if value.Exists() {
+				values = append(values, value.Raw)
+			}
+		}
+
+		if got := strings.Join(values, " "); got != test.want {
+			t.Errorf("KeyValues(%s) = %s, want %s", test.keyPath, got, test.want)
+		}
+	}
+}
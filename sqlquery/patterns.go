@@ -0,0 +1,66 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/busbud/tidalwave/logger"
+)
+
+// likeToRegex converts a LIKE pattern to an anchored regular expression, where % matches any amount of characters,
+// _ matches a single character, and characters following escape are matched literally.
+func likeToRegex(pattern, escape string) string {
+	escapeRune, _ := utf8.DecodeRuneInString(escape)
+	if utf8.RuneCountInString(escape) > 1 {
+		logger.Log.Panicf("ESCAPE must be a single character")
+	}
+
+	var regexString strings.Builder
+	regexString.WriteString("(?s)^")
+
+	escaped := false
+	for _, char := range pattern {
+		switch {
+		case escaped:
+			regexString.WriteString(regexp.QuoteMeta(string(char)))
+			escaped = false
+		case escape != "" && char == escapeRune:
+			escaped = true
+		case char == '%':
+			regexString.WriteString(".*")
+		case char == '_':
+			regexString.WriteString(".")
+		default:
+			regexString.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	if escaped {
+		logger.Log.Panicf("LIKE pattern must not end with the escape character")
+	}
+
+	regexString.WriteString("$")
+	return regexString.String()
+}
+
+// compilePattern builds the Regex field of a QueryParam for LIKE, ILIKE, and regular expression operators.
+func compilePattern(operator, pattern, escape string) *regexp.Regexp {
+	regexString := pattern
+	switch strings.TrimPrefix(operator, "!") {
+	case "~~", "~~*":
+		regexString = likeToRegex(pattern, escape)
+	}
+
+	if strings.HasSuffix(operator, "*") {
+		regexString = "(?i)" + regexString
+	}
+
+	regex, err := regexp.Compile(regexString)
+	if err != nil {
+		logger.Log.Panicf("Invalid pattern %s: %s", pattern, err.Error())
+	}
+
+	return regex
+}
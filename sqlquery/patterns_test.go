@@ -0,0 +1,87 @@
+package sqlquery
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		operator string
+		pattern  string
+		escape   string
+		value    string
+		want     bool
+	}{
+		{"~~", "abc", `\`, "abc", true},
+		{"~~", "abc", `\`, "abcd", false},
+		{"~~", "abc", `\`, "ABC", false},
+		{"~~", "a%", `\`, "a", true},
+		{"~~", "a%", `\`, "a\nb", true},
+		{"~~", "%b%", `\`, "abc", true},
+		{"~~", "%b%", `\`, "ac", false},
+		{"~~", "a_c", `\`, "abc", true},
+		{"~~", "a_c", `\`, "ac", false},
+		{"~~", "a_c", `\`, "aébc", false},
+		{"~~", "a_c", `\`, "aéc", true},
+		{"~~", "a.c", `\`, "abc", false},
+		{"~~", "(a)+", `\`, "(a)+", true},
+		{"~~", `100\%`, `\`, "100%", true},
+		{"~~", `100\%`, `\`, "1000", false},
+		{"~~", `a\_c`, `\`, "a_c", true},
+		{"~~", `a\_c`, `\`, "abc", false},
+		{"~~", `a\\c`, `\`, `a\c`, true},
+		{"~~", "100!%", "!", "100%", true},
+		{"~~", "100!%", "!", "1000", false},
+		{"~~", `a\%`, "!", `a\bc`, true},
+		{"~~", "a%", "", "abc", true},
+		{"!~~", "a%", `\`, "abc", false},
+		{"!~~", "a%", `\`, "bcd", true},
+
+		{"~~*", "ABC%", `\`, "abcdef", true},
+		{"~~*", "é_", `\`, "Éa", true},
+		{"~~*", `A\%`, `\`, "a%", true},
+		{"~~*", `A\%`, `\`, "ab", false},
+		{"!~~*", "abc", `\`, "ABC", false},
+
+		{"~", "^a.c$", `\`, "abc", true},
+		{"~", "b", `\`, "abc", true},
+		{"~", "^B", `\`, "bcd", false},
+		{"~*", "^B", `\`, "bcd", true},
+		{"!~", "b", `\`, "abc", false},
+		{"!~*", "B", `\`, "acd", true},
+	}
+
+	for _, test := range tests {
+		value, _ := json.Marshal(test.value)
+		line := []byte(`{"a":` + string(value) + `}`)
+		param := QueryParam{KeyPath: "a", Operator: test.operator, ValString: test.pattern, Regex: compilePattern(test.operator, test.pattern, test.escape)}
+
+		if match, _ := processParam(&param, &line); match != test.want {
+			t.Errorf("%q %s %q ESCAPE %q = %v, want %v", test.value, test.operator, test.pattern, test.escape, match, test.want)
+		}
+	}
+}
+
+func TestCompilePatternErrors(t *testing.T) {
+	tests := []struct {
+		operator string
+		pattern  string
+		escape   string
+	}{
+		{"~~", `abc\`, `\`},
+		{"~~", "abc", "!!"},
+		{"~", "a(", `\`},
+	}
+
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s %q ESCAPE %q didn't panic", test.operator, test.pattern, test.escape)
+				}
+			}()
+			compilePattern(test.operator, test.pattern, test.escape)
+		}()
+	}
+}
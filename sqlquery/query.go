@@ -5,11 +5,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/busbud/tidalwave/logger"
 	"github.com/davecgh/go-spew/spew"
 	pgQuery "github.com/lfittl/pg_query_go"
 	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/spf13/viper"
 	"github.com/tidwall/gjson"
 	dry "github.com/ungerik/go-dry"
 )
@@ -23,15 +25,36 @@ const (
 	TypeCountDistinct = "count-distinct"
 	// TypeSearch specifies specifies result is a search result
 	TypeSearch = "search"
+	// TypeGroupBy specifies result is a table of GROUP BY rows
+	TypeGroupBy = "group-by"
+	// TypeAggregate specifies result is a single aggregate function value
+	TypeAggregate = "aggregate"
+	// TypeTimeSeries specifies result is a table of GROUP BY rows ordered by time bucket
+	TypeTimeSeries = "time-series"
+	// TypeUnion specifies result is the rows of each query of a UNION
+	TypeUnion = "union"
 
 	// OperatorBetween constant.
 	OperatorBetween = "between"
 	// OperatorIn constant.
 	OperatorIn = "in"
+	// OperatorIsNull constant.
+	OperatorIsNull = "is null"
+	// OperatorIsNotNull constant.
+	OperatorIsNotNull = "is not null"
 )
 
-// List of operators that use the Regex field in QueryParam
-var regexOperators = []string{"regexp", "~~", "~~*"}
+// Types of constants compared against in WHERE clauses.
+const (
+	literalString = iota
+	literalNumber
+	literalBool
+	literalNull
+)
+
+// List of operators that use the Regex field in QueryParam. ~~ and ~~* are LIKE and ILIKE, where ~ and ~* are regular
+// expression matches. Operators starting with ! are their negated forms.
+var regexOperators = []string{"~~", "~~*", "!~~", "!~~*", "~", "~*", "!~", "!~*"}
 
 // List of supported postgres functions
 var supportedFunctions = []string{"count", "distinct"}
@@ -39,36 +62,119 @@ var supportedFunctions = []string{"count", "distinct"}
 // A list of strings replaced in a query string before being passed to the parser to avoid parsing errors.
 var stringReplacements = [][]string{
 	{"-", "__dash__"},
-	{".#.", ".__map__."},
+	{".#", ".__map__"},
 	{"''", "__twosinglequotes__"},
 }
 
 // QueryParam holds a single piece of a queries WHERE and SELECT statements to be processed on log lines
 type QueryParam struct {
-	IsInt          bool
+	Expression     *Expression // Compared instead of KeyPath when the WHERE clause calls a function
+	IsBool         bool
+	IsNumber       bool
 	KeyName        string
 	KeyPath        string
+	Needle         string // Literal text a line must contain to match a comparison against RawKey
+	NeedleFold     bool   // Needle is matched ignoring case
+	NullSafe       bool   // IS DISTINCT FROM and IS NOT DISTINCT FROM, where NULL is compared like any other value
 	Regex          *regexp.Regexp
 	Operator       string
-	ValInt         int
-	ValIntArray    []int
+	Quantifier     string       // QuantifierAny or QuantifierAll when comparing against each element of an array
+	Subquery       *QueryParams // Inner query of IN (SELECT ...), executed by the parser before the query itself
+	TextQuery      *TextQuery
+	ValBool        bool
+	ValJSON        gjson.Result // JSON constant compared against by @>
+	ValNumber      float64
+	ValNumberArray []float64
+	ValSet         map[string]struct{} // Values selected by Subquery, keyed by ValueKey
 	ValString      string
 	ValStringArray []string
 }
 
+// OrderParam holds a single key of a query's ORDER BY clause. Grouped queries are ordered by their output rows, where
+// KeyPath is the name of a column.
+type OrderParam struct {
+	KeyPath string
+	Desc    bool
+}
+
 // QueryParams holds all the information for a given query such SELECT, FROM, and WHERE statements to be easily processed later.
 type QueryParams struct {
 	SQLString      string
 	SQLStringLower string
 
-	From []string // TODO: Rename to Froms
+	From     []string       // TODO: Rename to Froms
+	Location *time.Location // Time zone of dates written without an offset
+
+	TimestampKey     string   // JSON path to each line's timestamp
+	TimestampLayouts []string // Go time layouts tried when parsing each line's timestamp
 
 	AggrPath  string
+	Columns   []Column
 	Dates     []DateParam
+	GroupBy   []GroupKey
+	Having    *QueryNode // Matched against each output row of a grouped query, see ProcessHaving
+	Limit     int        // -1 when the query has no LIMIT
+	Offset    int
+	OrderBy   []OrderParam
 	Queries   []QueryParam // TODO Rename to Where
 	QueryKeys []string
 	Selects   []string
 	Type      string
+	Where     *QueryNode
+
+	// Parallel to Selects, holding the Expression of selected functions and nil for selected keys.
+	SelectExpressions []*Expression
+
+	// Apps of a JOIN, in the order they're joined, along with their ON conditions.
+	Joins          []JoinTable
+	JoinConditions []JoinCondition
+
+	// Queries of the WITH clause, and of a UNION along with whether duplicate rows are kept.
+	With     []*WithQuery
+	Unions   []*QueryParams
+	UnionAll bool
+
+	prefilters  []rawFilter
+	timeFilters []timeFilter
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// replaceKeyDashes replaces dashes within keys and names such as line.request-id and my-app, leaving dashes with
+// spaces around them, dashes within numbers such as 10-5, and dashes within string constants to the parser.
+func replaceKeyDashes(queryString, replacement string) string {
+	var result strings.Builder
+	quoted := false
+	for idx := 0; idx < len(queryString); idx++ {
+		if queryString[idx] == '\'' {
+			quoted = !quoted
+		}
+
+		if queryString[idx] == '-' && !quoted && isKeyDash(queryString, idx) {
+			result.WriteString(replacement)
+			continue
+		}
+		result.WriteByte(queryString[idx])
+	}
+
+	return result.String()
+}
+
+// isKeyDash returns true if the dash at idx is between two word characters of an identifier, which starts with a
+// letter or underscore rather then a digit.
+func isKeyDash(queryString string, idx int) bool {
+	if idx == 0 || idx == len(queryString)-1 || !isWordChar(queryString[idx-1]) || !isWordChar(queryString[idx+1]) {
+		return false
+	}
+
+	start := idx
+	for start > 0 && (isWordChar(queryString[start-1]) || queryString[start-1] == '.' || queryString[start-1] == '-') {
+		start--
+	}
+
+	return queryString[start] < '0' || queryString[start] > '9'
 }
 
 func convertAConst(expr pgNodes.A_Const) string {
@@ -77,11 +183,24 @@ func convertAConst(expr pgNodes.A_Const) string {
 		return val.Str
 	case pgNodes.Integer:
 		return strconv.Itoa(int(val.Ival))
+	case pgNodes.Float:
+		return val.Str
 	}
 
 	return "" // TODO
 }
 
+// convertLimit returns the row count passed to LIMIT or OFFSET, returning false for LIMIT ALL.
+func convertLimit(node pgNodes.Node) (int, bool) {
+	if val, ok := node.(pgNodes.A_Const); ok {
+		if i, err := strconv.Atoi(convertAConst(val)); err == nil && i >= 0 {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
 // Postgres' SQL parser doesn't like some characters in parts of the query.
 // We replace them in New, and them restore them here after parsing the sql parsers response.
 func (qp *QueryParams) repairString(key string) string {
@@ -106,127 +225,345 @@ func (qp *QueryParams) getSelectNodeString(selectNodeVal pgNodes.ColumnRef) stri
 	return qp.repairString(strings.Join(selectStrings, "."))
 }
 
-func (qp *QueryParams) assignTypeFieldsToParam(param QueryParam, value string) QueryParam {
-	param.ValString = qp.repairString(stripQuotes(value))
-	if i, err := strconv.Atoi(value); err == nil {
-		param.IsInt = true
-		param.ValInt = i
-	} else if dry.StringListContains(regexOperators, param.Operator) {
-		// Handles building the Regex field on param when a string is selected
-		regexString := ""
-		if param.ValString[:1] == "%" && param.ValString[len(param.ValString)-1:] != "%" {
-			regexString = "^" + param.ValString[1:]
-		} else if param.ValString[:1] != "%" && param.ValString[len(param.ValString)-1:] == "%" {
-			regexString = param.ValString[:len(param.ValString)-1] + "$"
-		} else if param.ValString[:1] == "%" && param.ValString[len(param.ValString)-1:] == "%" {
-			regexString = param.ValString[1 : len(param.ValString)-1]
-		} else {
-			regexString = param.ValString
+// convertLiteral returns the value of a constant compared against in a WHERE clause along with its type, which is
+// taken from how the constant was written in the query. 1.5 is a number, '1.5' is a string, true is a boolean, and NULL
+// is a typed null.
+func (qp *QueryParams) convertLiteral(node pgNodes.Node) (string, int) {
+	switch val := node.(type) {
+	case pgNodes.A_Const:
+		switch val.Val.(type) {
+		case pgNodes.Integer, pgNodes.Float:
+			return convertAConst(val), literalNumber
+		case pgNodes.String:
+			return qp.repairString(convertAConst(val)), literalString
+		case pgNodes.Null:
+			return "", literalNull
+		}
+
+	case pgNodes.TypeCast:
+		// Postgres parses true and false as 't'::bool and 'f'::bool.
+		if typeName := val.TypeName; typeName != nil && len(typeName.Names.Items) > 0 {
+			if name, ok := typeName.Names.Items[len(typeName.Names.Items)-1].(pgNodes.String); ok && name.Str == "bool" {
+				if arg, ok := val.Arg.(pgNodes.A_Const); ok {
+					return strconv.FormatBool(convertAConst(arg) == "t"), literalBool
+				}
+			}
 		}
 
-		if param.Operator == "~~*" {
-			regexString = "(?i)" + regexString
+		if value, ok := qp.convertTimeExpression(val); ok {
+			return value, literalString
 		}
-		param.Regex = regexp.MustCompile(regexString)
+
+		return qp.convertLiteral(val.Arg)
+
+	case pgNodes.FuncCall, pgNodes.SQLValueFunction, pgNodes.A_Expr:
+		// now() - interval '15 minutes'
+		if value, ok := qp.convertTimeExpression(val); ok {
+			return value, literalString
+		}
+	}
+
+	logger.Log.Panicf("WHERE only supports comparing keys to strings, numbers, booleans, and times relative to now()")
+	return "", literalString
+}
+
+// nullParam turns a comparison against a NULL constant, which is never true or false, in to a comparison of NULL.
+func nullParam(param QueryParam) QueryParam {
+	param.KeyPath = ""
+	param.Expression = &Expression{Constant: &gjson.Result{}}
+	return param
+}
+
+func (qp *QueryParams) assignTypeFieldsToParam(param QueryParam, node pgNodes.Node) QueryParam {
+	// LIKE 'a!%%' ESCAPE '!' is parsed as a call to like_escape.
+	escape := `\`
+	if funcCall, ok := node.(pgNodes.FuncCall); ok && getFuncName(funcCall) == "like_escape" {
+		node = funcCall.Args.Items[0]
+		escape, _ = qp.convertLiteral(funcCall.Args.Items[1])
+	}
+
+	value, literalType := qp.convertLiteral(node)
+	if literalType == literalNull {
+		return nullParam(param)
+	}
+	param.ValString = value
+
+	switch literalType {
+	case literalNumber:
+		param.IsNumber = true
+		param.ValNumber, _ = strconv.ParseFloat(value, 64)
+	case literalBool:
+		param.IsBool = true
+		param.ValBool = value == "true"
+	}
+
+	if dry.StringListContains(regexOperators, param.Operator) {
+		param.Regex = compilePattern(param.Operator, param.ValString, escape)
+	}
+
+	if param.Operator == OperatorTextSearch {
+		param.TextQuery = ParseTextQuery(param.ValString)
+	}
+
+	if param.Operator == OperatorContains {
+		param.ValJSON = parseJSONLiteral(param.ValString)
+	}
+
+	if param.KeyPath == RawKey {
+		param.Needle, param.NeedleFold = rawNeedle(&param, escape)
 	}
 
 	return param
 }
 
-func (qp *QueryParams) handleCompareExpr(expr pgNodes.A_Expr) []QueryParam {
+func (qp *QueryParams) handleCompareExpr(expr pgNodes.A_Expr) *QueryNode {
 	// Param root used for everything except BETWEEN.
 	param := QueryParam{
-		KeyPath:  qp.getSelectNodeString(expr.Lexpr.(pgNodes.ColumnRef)),
 		Operator: strings.ToLower(expr.Name.Items[0].(pgNodes.String).Str),
 	}
 
-	switch right := expr.Rexpr.(type) {
-	case pgNodes.A_Const:
-		param = qp.assignTypeFieldsToParam(param, convertAConst(right))
+	// Postgres' parser turns != in to <>.
+	if param.Operator == "<>" {
+		param.Operator = "!="
+	}
+
+	if expr.Kind == pgNodes.AEXPR_OP_ANY || expr.Kind == pgNodes.AEXPR_OP_ALL {
+		return qp.handleQuantifiedExpr(expr, param.Operator)
+	}
 
+	if columnRef, ok := expr.Lexpr.(pgNodes.ColumnRef); ok {
+		param.KeyPath = qp.getSelectNodeString(columnRef)
+	} else {
+		param.Expression = qp.handleExpression(expr.Lexpr)
+	}
+
+	return qp.handleCompareValue(expr, param)
+}
+
+// handleCompareValue creates the node comparing param, which already holds the operator and left side of expr, against
+// the right side of expr.
+func (qp *QueryParams) handleCompareValue(expr pgNodes.A_Expr, param QueryParam) *QueryNode {
+	// IS DISTINCT FROM is parsed as = with a different kind.
+	switch expr.Kind {
+	case pgNodes.AEXPR_DISTINCT:
+		param.NullSafe = true
+		param.Operator = "!="
+	case pgNodes.AEXPR_NOT_DISTINCT:
+		param.NullSafe = true
+		param.Operator = "="
+	}
+
+	// IS DISTINCT FROM NULL is the same as IS NOT NULL.
+	if val, ok := expr.Rexpr.(pgNodes.A_Const); ok && param.NullSafe {
+		if _, ok := val.Val.(pgNodes.Null); ok {
+			param.NullSafe = false
+			if param.Operator == "!=" {
+				param.Operator = OperatorIsNotNull
+			} else {
+				param.Operator = OperatorIsNull
+			}
+
+			return newLeafNode(param)
+		}
+	}
+
+	switch right := expr.Rexpr.(type) {
 	case pgNodes.List:
 		if param.Operator == OperatorBetween {
 			fromQuery := qp.assignTypeFieldsToParam(QueryParam{
-				KeyPath:  param.KeyPath,
-				Operator: ">=",
-			}, convertAConst(right.Items[0].(pgNodes.A_Const)))
+				Expression: param.Expression,
+				KeyPath:    param.KeyPath,
+				Operator:   ">=",
+			}, right.Items[0])
 			toQuery := qp.assignTypeFieldsToParam(QueryParam{
-				KeyPath:  param.KeyPath,
-				Operator: "<=",
-			}, convertAConst(right.Items[1].(pgNodes.A_Const)))
+				Expression: param.Expression,
+				KeyPath:    param.KeyPath,
+				Operator:   "<=",
+			}, right.Items[1])
 
-			return []QueryParam{fromQuery, toQuery}
+			return newBoolNode(BoolAnd, newLeafNode(fromQuery), newLeafNode(toQuery))
 		}
 
 		// If we're comparing to a list, there's no way the operator is "=". Change it to "IN".
 		param.Operator = OperatorIn
 
-		for _, val := range right.Items {
-			val := convertAConst(val.(pgNodes.A_Const))
-			if i, err := strconv.Atoi(val); err == nil {
-				param.IsInt = true
-				param.ValIntArray = append(param.ValIntArray, i)
-			} else {
-				param.ValStringArray = append(param.ValStringArray, qp.repairString(stripQuotes(val)))
+		// Lists of only numbers are compared as numbers, otherwise every value is compared as a string.
+		param.IsNumber = true
+		hasNull := false
+		for _, item := range right.Items {
+			val, literalType := qp.convertLiteral(item)
+			if literalType == literalNull {
+				hasNull = true
+				continue
 			}
-		}
 
-		// We can't have mixed types wheh comparing arrays. We default to strings if not all values were convertable to
-		// numbers
-		if len(param.ValIntArray) > 0 && len(param.ValStringArray) != 0 {
-			param.IsInt = false
-			for _, val := range param.ValIntArray {
-				param.ValStringArray = append(param.ValStringArray, string(val))
+			param.ValStringArray = append(param.ValStringArray, val)
+			if literalType != literalNumber {
+				param.IsNumber = false
+				continue
 			}
-			param.ValIntArray = []int{}
+
+			f, _ := strconv.ParseFloat(val, 64)
+			param.ValNumberArray = append(param.ValNumberArray, f)
+		}
+
+		if !param.IsNumber {
+			param.ValNumberArray = nil
+		}
+
+		// IN (1, NULL) is true for 1, and otherwise unknown rather then false.
+		if hasNull {
+			return newBoolNode(BoolOr, newLeafNode(param), newLeafNode(nullParam(param)))
+		}
+
+	case pgNodes.A_ArrayExpr:
+		// line ?| array['a', 'b']
+		if param.Operator != OperatorHasAnyKey && param.Operator != OperatorHasAllKeys {
+			logger.Log.Panicf("ARRAY constants are only supported by ?|, ?&, ANY and ALL")
+		}
+
+		for _, item := range right.Elements.Items {
+			val, _ := qp.convertLiteral(item)
+			param.ValStringArray = append(param.ValStringArray, val)
 		}
+
+	default:
+		param = qp.assignTypeFieldsToParam(param, right)
 	}
 
-	return []QueryParam{param}
+	return newLeafNode(param)
 }
 
-func (qp *QueryParams) handleAndExpr(expr pgNodes.BoolExpr) []QueryParam {
-	params := []QueryParam{}
+func (qp *QueryParams) handleBoolExpr(expr pgNodes.BoolExpr) *QueryNode {
+	operator := BoolAnd
+	switch expr.Boolop {
+	case pgNodes.OR_EXPR:
+		operator = BoolOr
+	case pgNodes.NOT_EXPR:
+		operator = BoolNot
+	}
+
+	node := newBoolNode(operator)
 	for _, whereExpr := range expr.Args.Items {
-		params = append(params, qp.handleExpr(whereExpr)...)
+		node.Nodes = append(node.Nodes, qp.handleExpr(whereExpr))
 	}
 
-	return params
+	return node
 }
 
-func (qp *QueryParams) handleExpr(entry interface{}) []QueryParam {
-	params := []QueryParam{}
+func (qp *QueryParams) handleNullTest(expr pgNodes.NullTest) *QueryNode {
+	param := QueryParam{Operator: OperatorIsNull}
+	if columnRef, ok := expr.Arg.(pgNodes.ColumnRef); ok {
+		param.KeyPath = qp.getSelectNodeString(columnRef)
+	} else {
+		param.Expression = qp.handleExpression(expr.Arg)
+	}
+
+	if expr.Nulltesttype == pgNodes.IS_NOT_NULL {
+		param.Operator = OperatorIsNotNull
+	}
+
+	return newLeafNode(param)
+}
+
+func (qp *QueryParams) handleExpr(entry interface{}) *QueryNode {
 	switch expr := entry.(type) {
 	case pgNodes.A_Expr:
-		params = append(params, qp.handleCompareExpr(expr)...)
+		return qp.handleCompareExpr(expr)
 	case pgNodes.BoolExpr:
-		params = append(params, qp.handleAndExpr(expr)...)
+		return qp.handleBoolExpr(expr)
+	case pgNodes.NullTest:
+		return qp.handleNullTest(expr)
+	case pgNodes.SubLink:
+		return qp.handleSubLink(expr)
+	}
+
+	// Skipping the expression would silently change which lines match.
+	logger.Log.Panicf("Unsupported expression %T, conditions only support comparisons combined with AND, OR and NOT", entry)
+	return nil
+}
+
+// extractDates moves date comparisons found in the top level AND conditions of the WHERE tree in to Dates, where
+// they're used to select log files rather then being matched against each line.
+func (qp *QueryParams) extractDates(node *QueryNode) *QueryNode {
+	if node.Param != nil && node.Param.KeyPath == "date" {
+		qp.Dates = append(qp.Dates, createDateParam(node.Param.ValString, node.Param.Operator, qp.Location)...)
+		return nil
+	}
+
+	if node.Operator == BoolAnd {
+		nodes := []*QueryNode{}
+		for _, child := range node.Nodes {
+			if child = qp.extractDates(child); child != nil {
+				nodes = append(nodes, child)
+			}
+		}
+
+		if len(nodes) == 0 {
+			return nil
+		}
+		node.Nodes = nodes
+	}
+
+	return node
+}
+
+// addExistsParam requires a selected key to exist on a line for it to match by ANDing it with the WHERE tree.
+func (qp *QueryParams) addExistsParam(param QueryParam) {
+	qp.Queries = append(qp.Queries, param)
+	if qp.Where == nil {
+		qp.Where = newBoolNode(BoolAnd)
+	} else if qp.Where.Operator != BoolAnd {
+		qp.Where = newBoolNode(BoolAnd, qp.Where)
 	}
 
-	return params
+	qp.Where.Nodes = append(qp.Where.Nodes, newLeafNode(param))
 }
 
-// ProcessLine interates through all Queries created during the query parsing returning a bool stating whether all matched.
+// ProcessLine evaluates the WHERE tree created during the query parsing returning a bool stating whether the line matched.
 func (qp *QueryParams) ProcessLine(line *[]byte) bool {
-	for idx, path := range qp.QueryKeys {
-		value := gjson.GetBytes(*line, path)
-		if value.Type == 0 { // gjson way of saying key not found
+	for idx := range qp.prefilters {
+		if !qp.prefilters[idx].match(*line) {
 			return false
 		}
+	}
 
-		q := &qp.Queries[idx]
-		if q.IsInt && value.Type == gjson.Number {
-			if !ProcessInt(q, int(value.Num)) {
-				return false
-			}
-		} else {
-			if !ProcessString(q, value.String()) {
-				return false
-			}
-		}
+	if len(qp.timeFilters) > 0 && !qp.matchTimeFilters(*line) {
+		return false
+	}
+
+	if qp.Where == nil {
+		return true
 	}
 
-	return true
+	match, _ := processNode(qp.Where, line)
+	return match
+}
+
+// handleCountFunction handles selecting COUNT(*), COUNT(key) and COUNT(DISTINCT key).
+func (qp *QueryParams) handleCountFunction(funcCall pgNodes.FuncCall) {
+	if len(funcCall.Args.Items) > 0 {
+		qp.AggrPath = qp.getSelectNodeString(funcCall.Args.Items[0].(pgNodes.ColumnRef))
+		qp.Selects = append(qp.Selects, qp.AggrPath)
+		qp.SelectExpressions = append(qp.SelectExpressions, nil)
+		// COUNT(key) skips lines where the key is missing or set to null.
+		qp.addExistsParam(QueryParam{
+			KeyPath:  qp.AggrPath,
+			Operator: OperatorIsNotNull,
+		})
+	}
+
+	funcType := funcCall.Funcname.Items[0].(pgNodes.String).Str
+	if !dry.StringListContains(supportedFunctions, funcType) {
+		logger.Log.Panicf("%s is not a supported function", funcType)
+	}
+
+	// Default to just support count and distinct for now. Redo this later.
+	if funcCall.AggDistinct {
+		qp.Type = TypeCountDistinct
+	} else {
+		qp.Type = TypeCount
+	}
 }
 
 // New parses a query string and returns a newly created QueryParams struc holding all parsed data.
@@ -236,10 +573,19 @@ func New(queryString string) *QueryParams {
 		SQLString:      queryString,
 		SQLStringLower: strings.ToLower(queryString),
 		Type:           TypeSearch, // Default is search. TODO Move to if statement
+		Limit:          -1,
+		Location:       LoadLocation(viper.GetString("timezone")),
+
+		TimestampKey:     TimestampKey(),
+		TimestampLayouts: TimestampLayouts(),
 	}
 
 	// Replace characters that the SQL parser won't accept that will be reverted back after parsing
 	for _, entry := range stringReplacements {
+		if entry[0] == "-" {
+			queryString = replaceKeyDashes(queryString, entry[1])
+			continue
+		}
 		queryString = strings.ReplaceAll(queryString, entry[0], entry[1])
 	}
 
@@ -249,87 +595,170 @@ func New(queryString string) *QueryParams {
 	}
 
 	logger.Log.Debugf("Query Tree: %s", spew.Sdump(tree))
-	statement := tree.Statements[0].(pgNodes.RawStmt).Stmt.(pgNodes.SelectStmt)
+	var statement pgNodes.SelectStmt
+	for _, rawStatement := range tree.Statements {
+		switch stmt := rawStatement.(pgNodes.RawStmt).Stmt.(type) {
+		case pgNodes.VariableSetStmt:
+			qp.handleSetStmt(stmt)
+		case pgNodes.SelectStmt:
+			statement = stmt
+		default:
+			logger.Log.Panicf("Only SELECT and SET timezone statements are supported")
+		}
+	}
+
+	if statement.WithClause != nil {
+		qp.handleWithClause(*statement.WithClause)
+		statement.WithClause = nil
+	}
+	qp.handleSelectStmt(statement)
+
+	logger.Log.Debugf("Query Params: %s", spew.Sdump(qp))
+	return &qp
+}
+
+// handleSelectStmt fills the query params from a SELECT statement, which is either the query itself or a subquery.
+func (qp *QueryParams) handleSelectStmt(statement pgNodes.SelectStmt) {
+	if statement.WithClause != nil {
+		logger.Log.Panicf("WITH is only supported at the start of a query")
+	}
+
+	if statement.Op != pgNodes.SETOP_NONE {
+		qp.handleSetOperation(statement)
+		return
+	}
+
 	isDistrinct := len(statement.DistinctClause.Items) > 0
 
 	// Where clauses
 	if statement.WhereClause != nil {
-		for _, entry := range qp.handleExpr(statement.WhereClause) {
-			if entry.KeyPath == "date" {
-				qp.Dates = append(qp.Dates, createDateParam(entry.ValString, entry.Operator)...)
-			} else {
-				qp.Queries = append(qp.Queries, entry)
+		qp.Where = qp.extractDates(qp.handleExpr(statement.WhereClause))
+
+		walkParams(qp.Where, func(param *QueryParam) {
+			if param.KeyPath == "date" {
+				logger.Log.Panicf("date can only be compared within AND conditions")
 			}
-		}
+			qp.Queries = append(qp.Queries, *param)
+		})
+
+		qp.prefilters = rawPrefilters(qp.Where)
+		qp.timeFilters = newTimeFilters(qp.Dates)
 	}
 
 	// Select statements
-	for _, selectNode := range statement.TargetList.Items {
-		selectNode := selectNode.(pgNodes.ResTarget)
-		keyName := ""
-		keyPath := ""
+	if len(statement.GroupClause.Items) > 0 || usesAggregates(&statement) || (statement.HavingClause != nil && !countsDistinct(&statement)) {
+		qp.handleGroupBy(&statement)
+	} else {
+		for _, selectNode := range statement.TargetList.Items {
+			selectNode := selectNode.(pgNodes.ResTarget)
+			keyName := ""
+			keyPath := ""
+
+			if selectNode.Name != nil {
+				keyName = *selectNode.Name
+			}
 
-		if selectNode.Name != nil {
-			keyName = *selectNode.Name
-		}
+			switch selectNodeVal := selectNode.Val.(type) {
+			case pgNodes.ColumnRef: // Regular select statement
+				keyPath = qp.getSelectNodeString(selectNodeVal)
+				if len(keyPath) > 0 {
+					if keyName == "" {
+						keySplit := strings.Split(keyPath, ".")
+						keyName = keySplit[len(keySplit)-1]
+					}
+
+					// TODO Kill the need for SELECTS
+					qp.Selects = append(qp.Selects, keyPath)
+					qp.SelectExpressions = append(qp.SelectExpressions, nil)
+					qp.addExistsParam(QueryParam{
+						KeyName:  keyName,
+						KeyPath:  keyPath,
+						Operator: "exists",
+					})
+				}
 
-		switch selectNodeVal := selectNode.Val.(type) {
-		case pgNodes.ColumnRef: // Regular select statement
-			keyPath = qp.getSelectNodeString(selectNodeVal)
-			if len(keyPath) > 0 {
-				if keyName == "" {
-					keySplit := strings.Split(keyPath, ".")
-					keyName = keySplit[len(keySplit)-1]
+			case pgNodes.FuncCall, pgNodes.CoalesceExpr, pgNodes.CaseExpr, pgNodes.TypeCast, pgNodes.A_Expr:
+				if funcCall, ok := selectNodeVal.(pgNodes.FuncCall); ok && !isScalarFunction(getFuncName(funcCall)) {
+					qp.handleCountFunction(funcCall)
+					break
 				}
 
-				// TODO Kill the need for SELECTS
-				qp.Selects = append(qp.Selects, keyPath)
-				qp.Queries = append(qp.Queries, QueryParam{
-					KeyName:  keyName,
-					KeyPath:  keyPath,
-					Operator: "exists",
-				})
-			}
+				// Scalar functions such as lower(line.msg) and arithmetic are computed for each line.
+				if isDistrinct {
+					logger.Log.Panicf("DISTINCT only supports keys")
+				}
 
-		case pgNodes.FuncCall: // COUNT
-			if len(selectNodeVal.Args.Items) > 0 {
-				qp.AggrPath = qp.getSelectNodeString(selectNodeVal.Args.Items[0].(pgNodes.ColumnRef))
-				qp.Selects = append(qp.Selects, qp.AggrPath)
-				qp.Queries = append(qp.Queries, QueryParam{
-					KeyPath:  qp.AggrPath,
-					Operator: "exists",
-				})
+				expression := qp.handleExpression(selectNodeVal)
+				if keyName != "" {
+					expression.Name = keyName
+				}
+				qp.Selects = append(qp.Selects, "")
+				qp.SelectExpressions = append(qp.SelectExpressions, expression)
 			}
 
-			funcType := selectNodeVal.Funcname.Items[0].(pgNodes.String).Str
-			if !dry.StringListContains(supportedFunctions, funcType) {
-				logger.Log.Panicf("%s is not a supported function", funcType)
+			if isDistrinct && qp.Type != TypeCountDistinct {
+				qp.AggrPath = keyPath
+				qp.Type = TypeDistinct
 			}
+		}
+	}
 
-			// Default to just support count and distinct for now. Redo this later.
-			if selectNodeVal.AggDistinct {
-				qp.Type = TypeCountDistinct
-			} else {
-				qp.Type = TypeCount
+	// From clauses
+	for _, fromNode := range statement.FromClause.Items {
+		switch fromNode := fromNode.(type) {
+		case pgNodes.RangeVar:
+			qp.From = append(qp.From, qp.repairString(*fromNode.Relname))
+		case pgNodes.JoinExpr:
+			if len(statement.FromClause.Items) > 1 {
+				logger.Log.Panicf("JOIN can't be combined with other apps in FROM")
 			}
+			qp.handleJoinExpr(fromNode)
+		}
+	}
+
+	if statement.HavingClause != nil {
+		qp.handleHavingClause(&statement)
+	}
+
+	// Order by
+	for _, sortNode := range statement.SortClause.Items {
+		sortNode := sortNode.(pgNodes.SortBy)
+		if qp.hasOutputColumns() {
+			qp.OrderBy = append(qp.OrderBy, OrderParam{
+				KeyPath: qp.outputColumn(&statement, sortNode.Node),
+				Desc:    sortNode.SortbyDir == pgNodes.SORTBY_DESC,
+			})
+			continue
 		}
 
-		if isDistrinct && qp.Type != TypeCountDistinct {
-			qp.AggrPath = keyPath
-			qp.Type = TypeDistinct
+		columnRef, ok := sortNode.Node.(pgNodes.ColumnRef)
+		if !ok {
+			logger.Log.Panicf("ORDER BY only supports keys")
 		}
+
+		qp.OrderBy = append(qp.OrderBy, OrderParam{
+			KeyPath: qp.getKeyPath(columnRef),
+			Desc:    sortNode.SortbyDir == pgNodes.SORTBY_DESC,
+		})
 	}
 
-	// From clauses
-	for _, fromNode := range statement.FromClause.Items {
-		qp.From = append(qp.From, qp.repairString(*fromNode.(pgNodes.RangeVar).Relname))
+	// Limit and offset
+	if limit, ok := convertLimit(statement.LimitCount); ok {
+		qp.Limit = limit
+	}
+	if offset, ok := convertLimit(statement.LimitOffset); ok {
+		qp.Offset = offset
+	}
+
+	if len(qp.Joins) > 0 {
+		if (qp.Type != TypeSearch && qp.Type != TypeCount) || len(qp.OrderBy) > 0 {
+			logger.Log.Panicf("JOIN only supports selecting keys and COUNT(*), without ORDER BY")
+		}
+		qp.pushDownJoinWhere()
 	}
 
 	// Create QueryKeys to be used by ProcessLine
 	for _, query := range qp.Queries {
 		qp.QueryKeys = append(qp.QueryKeys, query.KeyPath)
 	}
-
-	logger.Log.Debugf("Query Params: %s", spew.Sdump(qp))
-	return &qp
 }
@@ -0,0 +1,101 @@
+package sqlquery
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+func TestReplaceKeyDashes(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"select line.request-id from my-app", "select line.request__dash__id from my__dash__app"},
+		{"select line.a-b-c, line.x-1 from app", "select line.a__dash__b__dash__c, line.x__dash__1 from app"},
+		{"select line.end - line.start from app", "select line.end - line.start from app"},
+		{"select 10-5, 1.5-2, 1e-5, line.a+-1 from app", "select 10-5, 1.5-2, 1e-5, line.a+-1 from app"},
+		{"select -line.offset, now()-interval '1 hour' from app", "select -line.offset, now()-interval '1 hour' from app"},
+		{"select * from app where line.a = 'x-y' and line.b-c = 'it''s-a'", "select * from app where line.a = 'x-y' and line.b__dash__c = 'it''s-a'"},
+		{"select * from app where date > '2016-10-05'", "select * from app where date > '2016-10-05'"},
+	}
+
+	for _, test := range tests {
+		if got := replaceKeyDashes(test.query, "__dash__"); got != test.want {
+			t.Errorf("replaceKeyDashes(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+// String constants are read as written, in every part of the query that takes one.
+func TestStringConstants(t *testing.T) {
+	sql := `SET timezone = 'America/Montreal'; select date_trunc('Hour', date), count(*) from app ` +
+		`where line.msg like '%Error "x"' and line.path ~ '^/API' and line.host = 'Web-1' and date > '2024-01-05' ` +
+		`and date > now() - interval '15 Minutes' group by 1`
+	qp := &QueryParams{SQLString: sql, SQLStringLower: strings.ToLower(sql), TimestampKey: "line.time"}
+
+	setting := "timezone"
+	qp.handleSetStmt(pgNodes.VariableSetStmt{Name: &setting, Args: pgNodes.List{Items: []pgNodes.Node{testConst("america/montreal")}}})
+	if qp.location().String() != "America/Montreal" {
+		t.Errorf("SET timezone = 'America/Montreal' set %s", qp.location())
+	}
+
+	key, _ := qp.getTimeGroupKey(testFuncCall("date_trunc", testConst("hour"), testColumnRef("date")))
+	if key.TimeUnit != "hour" {
+		t.Errorf("date_trunc('Hour', date) truncates to %s", key.TimeUnit)
+	}
+
+	if interval, ok := qp.convertInterval(testTypeCast(testConst("15 minutes"), "interval")); !ok || interval != 15*time.Minute {
+		t.Errorf("interval '15 Minutes' = %v", interval)
+	}
+
+	compare := func(operator, key, value string) *QueryNode {
+		return qp.handleCompareExpr(pgNodes.A_Expr{
+			Kind:  pgNodes.AEXPR_OP,
+			Name:  pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: operator}}},
+			Lexpr: testColumnRef(strings.Split(key, ".")...),
+			Rexpr: testConst(value),
+		})
+	}
+
+	tests := []struct {
+		name    string
+		node    *QueryNode
+		value   string
+		matches []string
+		misses  []string
+	}{
+		{"like", compare("~~", "line.msg", `%error "x"`), `%Error "x"`, []string{`an Error "x"`}, []string{`an Error x`, `an error "x"`}},
+		{"regular expression", compare("~", "line.path", "^/api"), "^/API", []string{"/API/v1"}, []string{"/api/v1", "/web/API"}},
+		{"=", compare("=", "line.host", "web-1"), "Web-1", []string{"Web-1"}, []string{"web-1", "'Web-1'"}},
+	}
+
+	for _, test := range tests {
+		if test.node.Param.ValString != test.value {
+			t.Errorf("%s compared against %s, want %s", test.name, test.node.Param.ValString, test.value)
+		}
+
+		for _, value := range test.matches {
+			line := []byte(`{"line":{"msg":` + strconv.Quote(value) + `,"path":` + strconv.Quote(value) + `,"host":` + strconv.Quote(value) + `}}`)
+			if match, _ := processNode(test.node, &line); !match {
+				t.Errorf("%s didn't match %s", test.name, value)
+			}
+		}
+
+		for _, value := range test.misses {
+			line := []byte(`{"line":{"msg":` + strconv.Quote(value) + `,"path":` + strconv.Quote(value) + `,"host":` + strconv.Quote(value) + `}}`)
+			if match, _ := processNode(test.node, &line); match {
+				t.Errorf("%s matched %s", test.name, value)
+			}
+		}
+	}
+
+	// Dates select log files in UTC, where the day after 2024-01-05 starts at 05:00 in Montreal.
+	if where := qp.extractDates(compare(">", "date", "2024-01-05")); where != nil || len(qp.Dates) != 1 ||
+		qp.Dates[0].Date != "2024-01-06T05:00:00" || qp.Dates[0].Operator != ">=" {
+		t.Errorf("date > '2024-01-05' selected %+v", qp.Dates)
+	}
+}
@@ -0,0 +1,322 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/busbud/tidalwave/logger"
+)
+
+// RawKey is the pseudo key matching against the entire log line rather then a single JSON key.
+// SELECT * FROM serverapp WHERE _raw ILIKE '%timeout%'
+const RawKey = "_raw"
+
+// OperatorTextSearch matches a text search query such as 'timeout & (upstream | !retry)' against a string.
+const OperatorTextSearch = "@@"
+
+// rawLine returns the raw log line without its trailing line break.
+func rawLine(line []byte) []byte {
+	return bytes.TrimRight(line, "\r\n")
+}
+
+// containsFold returns true if needle is within s, ignoring case.
+func containsFold(s, needle []byte) bool {
+	if len(needle) == 0 {
+		return true
+	}
+
+	first, _ := utf8.DecodeRune(needle)
+	lower, upper := byte(0), byte(0)
+	if first < utf8.RuneSelf {
+		lower, upper = byte(unicode.ToLower(first)), byte(unicode.ToUpper(first))
+	}
+
+	for idx := 0; idx+len(needle) <= len(s); idx++ {
+		// Quickly skip ahead to the next possible match for ASCII needles.
+		if lower != 0 {
+			next := bytes.IndexByte(s[idx:], lower)
+			if lower != upper {
+				if nextUpper := bytes.IndexByte(s[idx:], upper); nextUpper != -1 && (next == -1 || nextUpper < next) {
+					next = nextUpper
+				}
+			}
+
+			if next == -1 {
+				return false
+			}
+			idx += next
+			if idx+len(needle) > len(s) {
+				return false
+			}
+		}
+
+		if bytes.EqualFold(s[idx:idx+len(needle)], needle) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rawFilter is literal text a line must contain for the WHERE clause to match, checked against the raw bytes of a
+// line before any JSON is parsed.
+type rawFilter struct {
+	needle []byte
+	fold   bool
+}
+
+func (f *rawFilter) match(line []byte) bool {
+	if f.fold {
+		return containsFold(line, f.needle)
+	}
+
+	return bytes.Contains(line, f.needle)
+}
+
+// likeLiterals returns the literal text between the wildcards of a LIKE pattern.
+func likeLiterals(pattern, escape string) []string {
+	escapeRune, _ := utf8.DecodeRuneInString(escape)
+	literals := []string{}
+	current := strings.Builder{}
+
+	escaped := false
+	for _, char := range pattern {
+		switch {
+		case escaped:
+			current.WriteRune(char)
+			escaped = false
+		case escape != "" && char == escapeRune:
+			escaped = true
+		case char == '%' || char == '_':
+			literals = append(literals, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(char)
+		}
+	}
+
+	return append(literals, current.String())
+}
+
+func longest(values []string) string {
+	result := ""
+	for _, value := range values {
+		if len(value) > len(result) {
+			result = value
+		}
+	}
+
+	return result
+}
+
+// rawNeedle returns the longest literal text a line must contain to match a comparison against RawKey, along with
+// whether it should be matched ignoring case.
+func rawNeedle(q *QueryParam, escape string) (string, bool) {
+	switch q.Operator {
+	case "=", "==":
+		return q.ValString, false
+	case "~~", "~~*":
+		return longest(likeLiterals(q.ValString, escape)), q.Operator == "~~*"
+	case "~":
+		prefix, _ := q.Regex.LiteralPrefix()
+		return prefix, false
+	case OperatorTextSearch:
+		return longest(q.TextQuery.required()), true
+	}
+
+	return "", false
+}
+
+// rawPrefilters returns the needles of comparisons against RawKey that every matching line must contain, which are the
+// ones within the top level AND conditions of the WHERE tree.
+func rawPrefilters(node *QueryNode) []rawFilter {
+	filters := []rawFilter{}
+	if node == nil {
+		return filters
+	}
+
+	if node.Param != nil {
+		if node.Param.KeyPath == RawKey && node.Param.Needle != "" {
+			filters = append(filters, rawFilter{[]byte(node.Param.Needle), node.Param.NeedleFold})
+		}
+		return filters
+	}
+
+	if node.Operator == BoolAnd {
+		for _, child := range node.Nodes {
+			filters = append(filters, rawPrefilters(child)...)
+		}
+	}
+
+	return filters
+}
+
+// TextQuery is a parsed text search query used by @@, where terms are matched ignoring case and combined with
+// & (and), | (or), ! (not), and parentheses. Terms holding spaces or operators are wrapped in double quotes.
+type TextQuery struct {
+	Operator string
+	Nodes    []*TextQuery
+	Term     []byte
+}
+
+// Match returns true if text satisfies the text search query.
+func (tq *TextQuery) Match(text []byte) bool {
+	switch tq.Operator {
+	case BoolNot:
+		return !tq.Nodes[0].Match(text)
+	case BoolOr:
+		for _, node := range tq.Nodes {
+			if node.Match(text) {
+				return true
+			}
+		}
+		return false
+	case BoolAnd:
+		for _, node := range tq.Nodes {
+			if !node.Match(text) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return containsFold(text, tq.Term)
+}
+
+// required returns the terms that must be found for the query to match.
+func (tq *TextQuery) required() []string {
+	switch tq.Operator {
+	case BoolAnd:
+		terms := []string{}
+		for _, node := range tq.Nodes {
+			terms = append(terms, node.required()...)
+		}
+		return terms
+	case "":
+		return []string{string(tq.Term)}
+	}
+
+	return []string{}
+}
+
+type textQueryParser struct {
+	tokens []string
+	pos    int
+}
+
+// tokenizeTextQuery splits a text search query in to operators and terms. Quoted terms keep their opening quote so
+// they're never mistaken for operators.
+func tokenizeTextQuery(query string) []string {
+	tokens := []string{}
+	current := strings.Builder{}
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	quoted := false
+	for _, char := range query {
+		switch {
+		case quoted:
+			if char == '"' {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				quoted = false
+			} else {
+				current.WriteRune(char)
+			}
+		case char == '"':
+			flush()
+			current.WriteRune(char)
+			quoted = true
+		case strings.ContainsRune("&|!()", char):
+			flush()
+			tokens = append(tokens, string(char))
+		case unicode.IsSpace(char):
+			flush()
+		default:
+			current.WriteRune(char)
+		}
+	}
+	if quoted {
+		logger.Log.Panicf("Text search query is missing a closing quote")
+	}
+	flush()
+
+	return tokens
+}
+
+func (p *textQueryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *textQueryParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// parseOr handles the lowest precedence operator, followed by parseAnd and parseNot.
+func (p *textQueryParser) parseOr() *TextQuery {
+	node := p.parseAnd()
+	for p.peek() == "|" {
+		p.next()
+		if node.Operator != BoolOr {
+			node = &TextQuery{Operator: BoolOr, Nodes: []*TextQuery{node}}
+		}
+		node.Nodes = append(node.Nodes, p.parseAnd())
+	}
+
+	return node
+}
+
+func (p *textQueryParser) parseAnd() *TextQuery {
+	node := p.parseNot()
+	for p.peek() == "&" {
+		p.next()
+		if node.Operator != BoolAnd {
+			node = &TextQuery{Operator: BoolAnd, Nodes: []*TextQuery{node}}
+		}
+		node.Nodes = append(node.Nodes, p.parseNot())
+	}
+
+	return node
+}
+
+func (p *textQueryParser) parseNot() *TextQuery {
+	switch token := p.next(); token {
+	case "!":
+		return &TextQuery{Operator: BoolNot, Nodes: []*TextQuery{p.parseNot()}}
+	case "(":
+		node := p.parseOr()
+		if p.next() != ")" {
+			logger.Log.Panicf("Text search query is missing a closing parenthesis")
+		}
+		return node
+	case "", "&", "|", ")", `"`:
+		logger.Log.Panicf("Text search query has a missing term")
+		return nil
+	default:
+		return &TextQuery{Term: []byte(strings.TrimPrefix(token, `"`))}
+	}
+}
+
+// ParseTextQuery parses a text search query such as 'timeout & (upstream | !retry)'.
+func ParseTextQuery(query string) *TextQuery {
+	parser := textQueryParser{tokens: tokenizeTextQuery(query)}
+	node := parser.parseOr()
+	if parser.pos != len(parser.tokens) {
+		logger.Log.Panicf("Text search query %s could not be parsed", query)
+	}
+
+	return node
+}
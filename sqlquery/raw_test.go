@@ -0,0 +1,101 @@
+package sqlquery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTextQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		text  string
+		want  bool
+	}{
+		{"timeout", "upstream TIMEOUT", true},
+		{"timeout", "upstream", false},
+		{"timeout & upstream", "Upstream timeout", true},
+		{"timeout & upstream", "timeout", false},
+		{"timeout | reset", "connection reset", true},
+		{"timeout | reset", "refused", false},
+		{"!retry", "timeout", true},
+		{"!retry", "retry 3", false},
+		{"!!retry", "retry 3", true},
+		{"timeout & !retry", "timeout", true},
+		{"timeout & !retry", "timeout, retry 3", false},
+		{"!(timeout | reset)", "refused", true},
+		{"!(timeout | reset)", "reset", false},
+		{"timeout & (upstream | !retry)", "timeout", true},
+		{"timeout & (upstream | !retry)", "timeout retry", false},
+		{"timeout & (upstream | !retry)", "upstream timeout retry", true},
+		{"a | b & c", "a", true},
+		{"a | b & c", "b", false},
+
+		{`"connection reset"`, "Connection Reset by peer", true},
+		{`"connection reset"`, "reset connection", false},
+		{`"a & b"`, "a & b", true},
+		{`"a & b"`, "a b", false},
+		{`"!retry"`, "!retry", true},
+		{`"!retry"`, "timeout", false},
+		{`!"connection reset" & peer`, "reset by peer", true},
+		{`!"connection reset" & peer`, "connection reset by peer", false},
+		{`timeout|"(upstream)"`, "(upstream)", true},
+	}
+
+	for _, test := range tests {
+		if got := ParseTextQuery(test.query).Match([]byte(test.text)); got != test.want {
+			t.Errorf("%q @@ %q = %v, want %v", test.text, test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseTextQueryErrors(t *testing.T) {
+	for _, query := range []string{"", "timeout &", "& timeout", "(timeout", "timeout)", "timeout upstream", "!", `"timeout`, `""`, `timeout & ""`} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("ParseTextQuery(%q) didn't panic", query)
+				}
+			}()
+			ParseTextQuery(query)
+		}()
+	}
+}
+
+func TestTextQueryRequired(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"timeout", []string{"timeout"}},
+		{`timeout & "connection reset" & !retry`, []string{"timeout", "connection reset"}},
+		{"timeout | reset", []string{}},
+		{"!timeout", []string{}},
+	}
+
+	for _, test := range tests {
+		if got := ParseTextQuery(test.query).required(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseTextQuery(%q).required() = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestContainsFold(t *testing.T) {
+	tests := []struct {
+		s      string
+		needle string
+		want   bool
+	}{
+		{"Upstream Timeout", "timeout", true},
+		{"Upstream Timeout", "TIME", true},
+		{"Upstream", "timeout", false},
+		{"tim", "timeout", false},
+		{"ÉCHEC", "échec", true},
+		{"anything", "", true},
+	}
+
+	for _, test := range tests {
+		if got := containsFold([]byte(test.s), []byte(test.needle)); got != test.want {
+			t.Errorf("containsFold(%q, %q) = %v, want %v", test.s, test.needle, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"strconv"
+
+	"github.com/busbud/tidalwave/logger"
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/tidwall/gjson"
+)
+
+// ValueKey returns the key of a value within the hash set of a subquery's results, where numbers logged as 1 and 1.0
+// are the same value.
+func ValueKey(value gjson.Result) string {
+	if value.Type == gjson.Number {
+		return strconv.FormatFloat(value.Num, 'f', -1, 64)
+	}
+
+	return value.String()
+}
+
+// newChildQuery creates the query params of a subquery, a WITH query, or a UNION branch, sharing the settings and WITH
+// queries of the query it's in.
+func (qp *QueryParams) newChildQuery(statement pgNodes.SelectStmt) *QueryParams {
+	child := &QueryParams{
+		SQLString:      qp.SQLString,
+		SQLStringLower: qp.SQLStringLower,
+		Type:           TypeSearch,
+		Limit:          -1,
+		Location:       qp.Location,
+		With:           append([]*WithQuery{}, qp.With...),
+
+		TimestampKey:     qp.TimestampKey,
+		TimestampLayouts: qp.TimestampLayouts,
+	}
+	child.handleSelectStmt(statement)
+
+	return child
+}
+
+// newSubquery creates the query params of a subquery, which only needs the distinct values of its selected key.
+func (qp *QueryParams) newSubquery(statement pgNodes.SelectStmt) *QueryParams {
+	subquery := qp.newChildQuery(statement)
+
+	if (subquery.Type != TypeSearch && subquery.Type != TypeDistinct) || len(subquery.Selects) != 1 || subquery.SelectExpressions[0] != nil {
+		logger.Log.Panicf("Subqueries must select a single key")
+	}
+	if len(subquery.OrderBy) > 0 || subquery.Limit >= 0 || subquery.Offset > 0 {
+		logger.Log.Panicf("Subqueries don't support ORDER BY, LIMIT, or OFFSET")
+	}
+
+	subquery.Type = TypeDistinct
+	subquery.AggrPath = subquery.Selects[0]
+
+	return subquery
+}
+
+// handleSubLink handles key IN (SELECT key FROM app WHERE ...), where the values selected by the subquery are held in
+// a hash set that each line's key is looked up in.
+func (qp *QueryParams) handleSubLink(expr pgNodes.SubLink) *QueryNode {
+	operator := "="
+	if len(expr.OperName.Items) > 0 {
+		operator = expr.OperName.Items[0].(pgNodes.String).Str
+	}
+
+	if expr.SubLinkType != pgNodes.ANY_SUBLINK || operator != "=" {
+		logger.Log.Panicf("Subqueries are only supported by IN (SELECT ...)")
+	}
+
+	param := QueryParam{Operator: OperatorIn}
+	if columnRef, ok := expr.Testexpr.(pgNodes.ColumnRef); ok {
+		param.KeyPath = qp.getSelectNodeString(columnRef)
+	} else {
+		param.Expression = qp.handleExpression(expr.Testexpr)
+	}
+
+	if param.KeyPath == "date" || param.KeyPath == RawKey {
+		logger.Log.Panicf("%s can't be compared against a subquery", param.KeyPath)
+	}
+
+	param.Subquery = qp.newSubquery(expr.Subselect.(pgNodes.SelectStmt))
+	return newLeafNode(param)
+}
+
+// Subqueries returns the params of the WHERE tree compared against a subquery, whose ValSet is filled by the parser
+// before the query is executed.
+func (qp *QueryParams) Subqueries() []*QueryParam {
+	params := []*QueryParam{}
+	walkParams(qp.Where, func(param *QueryParam) {
+		if param.Subquery != nil {
+			params = append(params, param)
+		}
+	})
+
+	return params
+}
@@ -0,0 +1,77 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"github.com/busbud/tidalwave/logger"
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// WithQuery is a query of a WITH clause. The parser executes it before the query it's in, writing its results to a
+// temporary log file that the rest of the query can select FROM like any other app.
+// WITH errors AS (SELECT line.req_id FROM api WHERE line.level >= 50) SELECT COUNT(DISTINCT(req_id)) FROM errors
+type WithQuery struct {
+	Name    string
+	Query   *QueryParams
+	LogPath string // Set by the parser once the query has been executed
+}
+
+// WithQuery returns the WITH query of a name used in FROM, or nil if the name is an app.
+func (qp *QueryParams) WithQuery(name string) *WithQuery {
+	for idx := len(qp.With) - 1; idx >= 0; idx-- {
+		if qp.With[idx].Name == name {
+			return qp.With[idx]
+		}
+	}
+
+	return nil
+}
+
+// handleWithClause handles the WITH queries at the start of a query, where each may select FROM the ones before it.
+func (qp *QueryParams) handleWithClause(with pgNodes.WithClause) {
+	if with.Recursive {
+		logger.Log.Panicf("WITH RECURSIVE is not supported")
+	}
+
+	for _, node := range with.Ctes.Items {
+		cte := node.(pgNodes.CommonTableExpr)
+		statement, ok := cte.Ctequery.(pgNodes.SelectStmt)
+		if !ok {
+			logger.Log.Panicf("WITH only supports SELECT queries")
+		}
+
+		qp.With = append(qp.With, &WithQuery{
+			Name:  qp.repairString(*cte.Ctename),
+			Query: qp.newChildQuery(statement),
+		})
+	}
+}
+
+// handleSetOperation handles UNION and UNION ALL, where each branch is executed as its own query and their rows are
+// returned one after the other. Branches that are themselves a UNION of the same kind are flattened.
+func (qp *QueryParams) handleSetOperation(statement pgNodes.SelectStmt) {
+	if statement.Op != pgNodes.SETOP_UNION {
+		logger.Log.Panicf("Only UNION and UNION ALL are supported")
+	}
+	if len(statement.SortClause.Items) > 0 {
+		logger.Log.Panicf("ORDER BY is not supported with UNION")
+	}
+
+	qp.Type = TypeUnion
+	qp.UnionAll = statement.All
+	for _, branchStatement := range []*pgNodes.SelectStmt{statement.Larg, statement.Rarg} {
+		branch := qp.newChildQuery(*branchStatement)
+		if branch.Type == TypeUnion && branch.UnionAll == qp.UnionAll && branch.Limit < 0 && branch.Offset == 0 {
+			qp.Unions = append(qp.Unions, branch.Unions...)
+			continue
+		}
+
+		qp.Unions = append(qp.Unions, branch)
+	}
+
+	if limit, ok := convertLimit(statement.LimitCount); ok {
+		qp.Limit = limit
+	}
+	if offset, ok := convertLimit(statement.LimitOffset); ok {
+		qp.Offset = offset
+	}
+}
@@ -0,0 +1,167 @@
+// Package sqlquery handles parsing SQL and converting to a dialect for Tidalwave.
+package sqlquery
+
+import (
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// BoolAnd matches when all child nodes match.
+	BoolAnd = "and"
+	// BoolOr matches when any child node matches.
+	BoolOr = "or"
+	// BoolNot matches when its single child node does not match.
+	BoolNot = "not"
+)
+
+// QueryNode is a single node of the boolean tree built from a query's WHERE clause. Branch nodes combine their
+// children with BoolAnd, BoolOr or BoolNot, while leaf nodes hold the QueryParam to compare against a log line.
+type QueryNode struct {
+	Operator string
+	Nodes    []*QueryNode
+	Param    *QueryParam
+}
+
+func newLeafNode(param QueryParam) *QueryNode {
+	return &QueryNode{Param: &param}
+}
+
+func newBoolNode(operator string, nodes ...*QueryNode) *QueryNode {
+	return &QueryNode{Operator: operator, Nodes: nodes}
+}
+
+// walkParams calls callback for every QueryParam found in the leaves of node.
+func walkParams(node *QueryNode, callback func(*QueryParam)) {
+	if node == nil {
+		return
+	}
+
+	if node.Param != nil {
+		callback(node.Param)
+		return
+	}
+
+	for _, child := range node.Nodes {
+		walkParams(child, callback)
+	}
+}
+
+// processParam compares a single QueryParam against a log line. A key that is missing from the line and a key set to
+// JSON null are both NULL, where known is false as SQL comparisons against NULL are neither true or false. IS NULL and
+// IS DISTINCT FROM are always known. Checking that a selected key exists tells the two apart, matching keys set to
+// JSON null but not missing keys.
+func processParam(q *QueryParam, line *[]byte) (match, known bool) {
+	if q.KeyPath == RawKey {
+		return processRaw(q, rawLine(*line)), true
+	}
+
+	var value gjson.Result
+	if q.Expression != nil {
+		value = q.Expression.Eval(*line)
+	} else {
+		value = gjson.GetBytes(*line, q.KeyPath)
+	}
+	exists := value.Exists()           // False when the key is missing from the line
+	isNull := value.Type == gjson.Null // Missing, or explicitly set to null
+
+	switch q.Operator {
+	case "exists":
+		return exists, true
+	case OperatorIsNull:
+		return isNull, true
+	case OperatorIsNotNull:
+		return !isNull, true
+	}
+
+	if isNull {
+		if q.NullSafe {
+			return q.Operator == "!=", true
+		}
+		return false, false
+	}
+
+	if q.Quantifier != "" {
+		return processQuantified(q, value)
+	}
+
+	return processValue(q, value), true
+}
+
+// processRaw compares the entire log line, avoiding converting the line to a string where possible.
+func processRaw(q *QueryParam, line []byte) bool {
+	switch q.Operator {
+	case OperatorTextSearch:
+		return q.TextQuery.Match(line)
+	case "~~", "~~*", "~", "~*":
+		return q.Regex.Match(line)
+	case "!~~", "!~~*", "!~", "!~*":
+		return !q.Regex.Match(line)
+	case OperatorContains, OperatorHasKey, OperatorHasAnyKey, OperatorHasAllKeys:
+		return processValue(q, gjson.ParseBytes(line))
+	}
+
+	return ProcessString(q, string(line))
+}
+
+// processValue compares a value that isn't NULL using the type of the query's constant.
+func processValue(q *QueryParam, value gjson.Result) bool {
+	if q.Subquery != nil {
+		_, ok := q.ValSet[ValueKey(value)]
+		return ok
+	}
+
+	switch q.Operator {
+	case OperatorContains:
+		return processContains(q, value)
+	case OperatorHasKey, OperatorHasAnyKey, OperatorHasAllKeys:
+		return processHasKeys(q, value)
+	}
+
+	if q.IsNumber && value.Type == gjson.Number {
+		return ProcessNumber(q, value.Num)
+	}
+
+	if q.IsBool && (value.Type == gjson.True || value.Type == gjson.False) {
+		return ProcessBool(q, value.Bool())
+	}
+
+	return ProcessString(q, value.String())
+}
+
+// processNode evaluates node against a log line using SQL's three valued logic, so NOT of an unknown comparison
+// stays unknown and is never returned.
+func processNode(node *QueryNode, line *[]byte) (match, known bool) {
+	if node.Param != nil {
+		return processParam(node.Param, line)
+	}
+
+	switch node.Operator {
+	case BoolNot:
+		match, known = processNode(node.Nodes[0], line)
+		return !match && known, known
+	case BoolOr:
+		known = true
+		for _, child := range node.Nodes {
+			childMatch, childKnown := processNode(child, line)
+			if childMatch {
+				return true, true
+			}
+			if !childKnown {
+				known = false
+			}
+		}
+		return false, known
+	default: // BoolAnd
+		known = true
+		for _, child := range node.Nodes {
+			childMatch, childKnown := processNode(child, line)
+			if childKnown && !childMatch {
+				return false, true
+			}
+			if !childKnown {
+				known = false
+			}
+		}
+		return known, known
+	}
+}
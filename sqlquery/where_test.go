@@ -0,0 +1,183 @@
+package sqlquery
+
+import (
+	"testing"
+
+	"github.com/busbud/tidalwave/logger"
+	pgNodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+func init() { logger.Init(false) }
+
+// Lines used by the WHERE tests, where a is the key being compared.
+var (
+	lineMatch   = []byte(`{"a":1}`)
+	lineNoMatch = []byte(`{"a":2}`)
+	lineNull    = []byte(`{"a":null}`)
+	lineMissing = []byte(`{"b":1}`)
+)
+
+func TestProcessParamNulls(t *testing.T) {
+	tests := []struct {
+		name  string
+		param QueryParam
+		line  []byte
+		match bool
+		known bool
+	}{
+		{"= on a match", QueryParam{KeyPath: "a", Operator: "=", IsNumber: true, ValNumber: 1}, lineMatch, true, true},
+		{"= on another value", QueryParam{KeyPath: "a", Operator: "=", IsNumber: true, ValNumber: 1}, lineNoMatch, false, true},
+		{"= on null", QueryParam{KeyPath: "a", Operator: "=", IsNumber: true, ValNumber: 1}, lineNull, false, false},
+		{"= on a missing key", QueryParam{KeyPath: "a", Operator: "=", IsNumber: true, ValNumber: 1}, lineMissing, false, false},
+		{"!= on null", QueryParam{KeyPath: "a", Operator: "!=", IsNumber: true, ValNumber: 1}, lineNull, false, false},
+
+		{"IS NULL on a value", QueryParam{KeyPath: "a", Operator: OperatorIsNull}, lineMatch, false, true},
+		{"IS NULL on null", QueryParam{KeyPath: "a", Operator: OperatorIsNull}, lineNull, true, true},
+		{"IS NULL on a missing key", QueryParam{KeyPath: "a", Operator: OperatorIsNull}, lineMissing, true, true},
+		{"IS NOT NULL on a value", QueryParam{KeyPath: "a", Operator: OperatorIsNotNull}, lineMatch, true, true},
+		{"IS NOT NULL on null", QueryParam{KeyPath: "a", Operator: OperatorIsNotNull}, lineNull, false, true},
+		{"IS NOT NULL on a missing key", QueryParam{KeyPath: "a", Operator: OperatorIsNotNull}, lineMissing, false, true},
+
+		{"exists on a value", QueryParam{KeyPath: "a", Operator: "exists"}, lineMatch, true, true},
+		{"exists on null", QueryParam{KeyPath: "a", Operator: "exists"}, lineNull, true, true},
+		{"exists on a missing key", QueryParam{KeyPath: "a", Operator: "exists"}, lineMissing, false, true},
+		{"? on null", QueryParam{KeyPath: "line", Operator: OperatorHasKey, ValString: "a"}, []byte(`{"line":{"a":null}}`), true, true},
+		{"? on a missing key", QueryParam{KeyPath: "line", Operator: OperatorHasKey, ValString: "a"}, []byte(`{"line":{"b":1}}`), false, true},
+
+		{"IS DISTINCT FROM on a match", QueryParam{KeyPath: "a", Operator: "!=", NullSafe: true, IsNumber: true, ValNumber: 1}, lineMatch, false, true},
+		{"IS DISTINCT FROM on null", QueryParam{KeyPath: "a", Operator: "!=", NullSafe: true, IsNumber: true, ValNumber: 1}, lineNull, true, true},
+		{"IS DISTINCT FROM on a missing key", QueryParam{KeyPath: "a", Operator: "!=", NullSafe: true, IsNumber: true, ValNumber: 1}, lineMissing, true, true},
+		{"IS NOT DISTINCT FROM on null", QueryParam{KeyPath: "a", Operator: "=", NullSafe: true, IsNumber: true, ValNumber: 1}, lineNull, false, true},
+	}
+
+	for _, test := range tests {
+		param := test.param
+		line := test.line
+		match, known := processParam(&param, &line)
+		if match != test.match || known != test.known {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, match, known, test.match, test.known)
+		}
+	}
+}
+
+func TestProcessNode(t *testing.T) {
+	// a = 1 is true on lineMatch, false on lineNoMatch, and unknown on lineNull.
+	a := newLeafNode(QueryParam{KeyPath: "a", Operator: "=", IsNumber: true, ValNumber: 1})
+	// b IS NULL is true on every line but lineMissing, and always known.
+	b := newLeafNode(QueryParam{KeyPath: "b", Operator: OperatorIsNull})
+
+	tests := []struct {
+		name  string
+		node  *QueryNode
+		line  []byte
+		match bool
+		known bool
+	}{
+		{"NOT true", newBoolNode(BoolNot, a), lineMatch, false, true},
+		{"NOT false", newBoolNode(BoolNot, a), lineNoMatch, true, true},
+		{"NOT unknown", newBoolNode(BoolNot, a), lineNull, false, false},
+		{"NOT NOT unknown", newBoolNode(BoolNot, newBoolNode(BoolNot, a)), lineNull, false, false},
+
+		{"true AND true", newBoolNode(BoolAnd, a, b), lineMatch, true, true},
+		{"false AND true", newBoolNode(BoolAnd, a, b), lineNoMatch, false, true},
+		{"unknown AND true", newBoolNode(BoolAnd, a, b), lineNull, false, false},
+		{"unknown AND false", newBoolNode(BoolAnd, a, newBoolNode(BoolNot, b)), lineNull, false, true},
+		{"NOT (unknown AND false)", newBoolNode(BoolNot, newBoolNode(BoolAnd, a, newBoolNode(BoolNot, b))), lineNull, true, true},
+
+		{"true OR false", newBoolNode(BoolOr, a, newBoolNode(BoolNot, b)), lineMatch, true, true},
+		{"false OR false", newBoolNode(BoolOr, a, newBoolNode(BoolNot, b)), lineNoMatch, false, true},
+		{"unknown OR true", newBoolNode(BoolOr, a, b), lineNull, true, true},
+		{"unknown OR false", newBoolNode(BoolOr, a, newBoolNode(BoolNot, b)), lineNull, false, false},
+		{"NOT (unknown OR false)", newBoolNode(BoolNot, newBoolNode(BoolOr, a, newBoolNode(BoolNot, b))), lineNull, false, false},
+	}
+
+	for _, test := range tests {
+		line := test.line
+		match, known := processNode(test.node, &line)
+		if match != test.match || known != test.known {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, match, known, test.match, test.known)
+		}
+
+		// ProcessLine only returns lines where the WHERE tree is known to be true.
+		qp := &QueryParams{Where: test.node}
+		if got := qp.ProcessLine(&line); got != (test.match && test.known) {
+			t.Errorf("%s: ProcessLine returned %v", test.name, got)
+		}
+	}
+}
+
+func TestHandleExprUnsupported(t *testing.T) {
+	sql := "select * from app where not line.cached"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("NOT of a key without a comparison didn't panic")
+		}
+	}()
+
+	qp.handleExpr(pgNodes.BoolExpr{Boolop: pgNodes.NOT_EXPR, Args: pgNodes.List{Items: []pgNodes.Node{
+		pgNodes.ColumnRef{Fields: pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: "line"}, pgNodes.String{Str: "cached"}}}},
+	}}})
+}
+
+// Constants are compared with the type they're written with in the query.
+func TestHandleCompareExprTypes(t *testing.T) {
+	sql := "select * from app where a = 1.5 and b = '1.5' and c = true and d in (1, 2.5) and e in (1, 'x') and f > 'm'"
+	qp := &QueryParams{SQLString: sql, SQLStringLower: sql}
+
+	number := func(value string) pgNodes.Node { return pgNodes.A_Const{Val: pgNodes.Float{Str: value}} }
+	integer := func(value int64) pgNodes.Node { return pgNodes.A_Const{Val: pgNodes.Integer{Ival: value}} }
+	str := func(value string) pgNodes.Node { return pgNodes.A_Const{Val: pgNodes.String{Str: value}} }
+	boolean := pgNodes.TypeCast{
+		Arg:      str("t"),
+		TypeName: &pgNodes.TypeName{Names: pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: "pg_catalog"}, pgNodes.String{Str: "bool"}}}},
+	}
+	compare := func(key, operator string, value pgNodes.Node) *QueryNode {
+		return qp.handleCompareExpr(pgNodes.A_Expr{
+			Kind:  pgNodes.AEXPR_OP,
+			Name:  pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: operator}}},
+			Lexpr: pgNodes.ColumnRef{Fields: pgNodes.List{Items: []pgNodes.Node{pgNodes.String{Str: key}}}},
+			Rexpr: value,
+		})
+	}
+
+	tests := []struct {
+		name    string
+		node    *QueryNode
+		matches []string
+		misses  []string
+	}{
+		{"a = 1.5", compare("a", "=", number("1.5")), []string{`{"a":1.5}`, `{"a":1.50}`}, []string{`{"a":1}`, `{"a":15}`}},
+		{"b = '1.5'", compare("b", "=", str("1.5")), []string{`{"b":"1.5"}`}, []string{`{"b":"1.50"}`}},
+		{"c = true", compare("c", "=", boolean), []string{`{"c":true}`}, []string{`{"c":false}`, `{"c":1}`}},
+		{"d in (1, 2.5)", compare("d", "=", pgNodes.List{Items: []pgNodes.Node{integer(1), number("2.5")}}),
+			[]string{`{"d":1}`, `{"d":2.50}`}, []string{`{"d":2}`, `{"d":"x"}`}},
+		{"e in (1, 'x')", compare("e", "=", pgNodes.List{Items: []pgNodes.Node{integer(1), str("x")}}),
+			[]string{`{"e":1}`, `{"e":"x"}`}, []string{`{"e":"y"}`, `{"e":2}`}},
+		{"f > 'm'", compare("f", ">", str("m")), []string{`{"f":"n"}`, `{"f":"mm"}`}, []string{`{"f":"a"}`, `{"f":"m"}`}},
+	}
+
+	for _, test := range tests {
+		for _, raw := range test.matches {
+			line := []byte(raw)
+			if match, known := processNode(test.node, &line); !match || !known {
+				t.Errorf("%s didn't match %s", test.name, raw)
+			}
+		}
+
+		for _, raw := range test.misses {
+			line := []byte(raw)
+			if match, _ := processNode(test.node, &line); match {
+				t.Errorf("%s matched %s", test.name, raw)
+			}
+		}
+	}
+
+	if param := compare("d", "=", pgNodes.List{Items: []pgNodes.Node{integer(1), number("2.5")}}).Param; !param.IsNumber || len(param.ValNumberArray) != 2 {
+		t.Errorf("IN list of numbers isn't compared as numbers: %+v", param)
+	}
+	if param := compare("e", "=", pgNodes.List{Items: []pgNodes.Node{integer(1), str("x")}}).Param; param.IsNumber || len(param.ValNumberArray) != 0 {
+		t.Errorf("IN list of mixed types isn't compared as strings: %+v", param)
+	}
+}